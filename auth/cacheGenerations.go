@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"fmt"
+	"sync"
+)
+
+// cacheGenerations versions the cached oidc tenants, in total and per issuer.
+// A discovery is only cached if the generation of its issuer did not change while it was in flight, see Middleware.InvalidateCache.
+type cacheGenerations struct {
+	mu      sync.Mutex
+	all     uint64
+	issuers map[string]uint64
+}
+
+// of returns the current generation of the issuer
+func (g *cacheGenerations) of(issuer string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return fmt.Sprintf("%d.%d", g.all, g.issuers[issuer])
+}
+
+// invalidate starts a new generation of the issuer
+func (g *cacheGenerations) invalidate(issuer string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.issuers == nil {
+		g.issuers = make(map[string]uint64)
+	}
+	g.issuers[issuer]++
+}
+
+// invalidateAll starts a new generation of all issuers
+func (g *cacheGenerations) invalidateAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.all++
+	// the issuer generations are reset, the new total generation distinguishes them from before
+	g.issuers = nil
+}
@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheJanitor deletes the expired entries of the caches periodically until it is stopped.
+// It references the caches only and never the Middleware, so that a Middleware which is not closed can still be garbage collected,
+// its finalizer stops the janitor then, like the janitor of go-cache.
+type cacheJanitor struct {
+	caches   []*lruCache
+	clock    func() time.Time
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startCacheJanitor starts a goroutine which deletes the expired entries of the caches every interval
+func startCacheJanitor(interval time.Duration, clock func() time.Time, caches ...*lruCache) *cacheJanitor {
+	j := &cacheJanitor{
+		caches: caches,
+		clock:  clock,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go j.run(interval)
+	return j
+}
+
+func (j *cacheJanitor) run(interval time.Duration) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stopCh:
+			return
+		case <-ticker.C:
+			for _, cache := range j.caches {
+				cache.deleteExpired(j.clock())
+			}
+		}
+	}
+}
+
+// stop signals the goroutine to return, it is safe to call stop multiple times
+func (j *cacheJanitor) stop() {
+	j.stopOnce.Do(func() {
+		close(j.stopCh)
+	})
+}
@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import "sync/atomic"
+
+// CacheStats is a snapshot of the caches of the Middleware, e.g. for debug endpoints. The counters are cumulative since NewMiddleware,
+// they are not reset by InvalidateCache or ClearCache. See Options.MetricsRecorder to export them continuously instead.
+type CacheStats struct {
+	Tenants        CacheCounts // Tenants is the cache of oidc tenants, i.e. discoveries and JWKs per issuer. A lookup which requires a discovery is a miss
+	Tokens         CacheCounts // Tokens is the cache of validated tokens, it is empty unless Options.EnableTokenCache is set
+	Introspections CacheCounts // Introspections is the cache of introspection results, it is empty unless Options.EnableIntrospection is set
+	JWKsRefreshes  uint64      // JWKsRefreshes counts the forced JWKs fetches because of an unknown key id, e.g. after a key rotation
+}
+
+// CacheCounts are the number of entries and the counted lookups and evictions of a single cache
+type CacheCounts struct {
+	Entries   int    // Entries is the current number of cached entries, including expired ones which have not been cleaned up yet
+	Hits      uint64 // Hits counts the lookups answered from the cache
+	Misses    uint64 // Misses counts the lookups of entries which were not cached, expired or outdated
+	Evictions uint64 // Evictions counts the least recently used entries which were evicted because the cache was full
+}
+
+// CacheStats returns the current entries and the hits, misses, evictions and JWKs refreshes of the caches
+func (m *Middleware) CacheStats() CacheStats {
+	stats := CacheStats{
+		Tenants:       m.oidcTenants.stats(),
+		JWKsRefreshes: atomic.LoadUint64(&m.jwksRefreshes),
+	}
+	if m.tokenCache != nil {
+		stats.Tokens = m.tokenCache.tokens.stats()
+	}
+	if m.introspections != nil {
+		stats.Introspections = m.introspections.stats()
+	}
+	return stats
+}
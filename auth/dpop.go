@@ -0,0 +1,180 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jws"
+)
+
+const (
+	dpopScheme                    = "DPoP"
+	dpopHeader                    = "DPoP"
+	dpopProofType                 = "dpop+jwt"
+	claimCnfMemberJkt             = "jkt"
+	defaultDPoPReplayCacheMaxSize = 10000
+)
+
+// Errors returned by the DPoP proof of possession check (RFC 9449), see Options.EnableDPoP
+var (
+	ErrMissingDPoPProof = errors.New("request provides no DPoP proof for the DPoP bound token")
+	ErrInvalidDPoPProof = errors.New("DPoP proof is invalid")
+	ErrDPoPKeyMismatch  = errors.New("DPoP proof key does not match the cnf jkt of the token")
+	ErrDPoPReplay       = errors.New("DPoP proof has been used before")
+	// ErrDPoPReplayCacheFull is returned if more proofs are used within Options.DPoPProofWindow than Options.DPoPReplayCacheMaxSize.
+	// The proofs are rejected then, as their reuse can not be detected without forgetting used proofs which are still valid.
+	ErrDPoPReplayCacheFull = errors.New("DPoP proof can not be checked for reuse, the replay cache is full")
+)
+
+// dpopClaims are the claims of the DPoP proof JWT which are checked against the request and the access token
+type dpopClaims struct {
+	HTTPMethod      string `json:"htm"`
+	HTTPURI         string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	JwtID           string `json:"jti"`
+	AccessTokenHash string `json:"ath"`
+}
+
+// dpopHeaderExtractor extracts the token of the 'DPoP <token>' Authorization header. It returns false if the request uses another scheme.
+func dpopHeaderExtractor(r *http.Request) (string, bool) {
+	splitAuthHeader := strings.Fields(r.Header.Get(authorization))
+	if len(splitAuthHeader) == 2 && strings.EqualFold(splitAuthHeader[0], dpopScheme) {
+		return splitAuthHeader[1], true
+	}
+	return "", false
+}
+
+// validateDPoP checks the DPoP proof of the request if the token is bound to a key by its 'cnf' member 'jkt'.
+// Tokens without 'jkt' are plain bearer tokens, they must not be presented with the DPoP scheme.
+func (m *Middleware) validateDPoP(r *http.Request, token Token, dpopSchemeUsed bool) error {
+	jkt, err := token.getCnfClaimMember(claimCnfMemberJkt)
+	switch {
+	case err != nil:
+		return err
+	case jkt == "" && dpopSchemeUsed:
+		return fmt.Errorf("%w: token is not DPoP bound, but presented with the DPoP scheme", ErrDPoPKeyMismatch)
+	case jkt == "":
+		return nil
+	case !dpopSchemeUsed:
+		return fmt.Errorf("%w: DPoP bound token must be presented with the DPoP scheme", ErrMissingDPoPProof)
+	}
+
+	proofs := r.Header.Values(dpopHeader)
+	if len(proofs) != 1 {
+		return fmt.Errorf("%w: request has %d DPoP headers, exactly one is required", ErrMissingDPoPProof, len(proofs))
+	}
+	claims, thumbprint, err := verifyDPoPProof(proofs[0])
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(jkt)) != 1 {
+		return ErrDPoPKeyMismatch
+	}
+	if err := m.validateDPoPClaims(r, token, claims); err != nil {
+		return err
+	}
+	// the proof is accepted as long as its iat is within the window, so it is remembered that long
+	expiry := time.Unix(claims.IssuedAt, 0).Add(m.options.DPoPProofWindow)
+	added, err := m.dpopProofs.add(tokenCacheKey(jkt+"."+claims.JwtID), struct{}{}, expiry, m.options.Clock())
+	if err != nil {
+		m.options.Logger.Error("DPoP replay cache is full, proofs are rejected", "max_size", m.options.DPoPReplayCacheMaxSize)
+		return fmt.Errorf("%w: %v", ErrDPoPReplayCacheFull, err)
+	}
+	if !added {
+		return ErrDPoPReplay
+	}
+	return nil
+}
+
+// verifyDPoPProof verifies the signature of the proof with the public key of its 'jwk' header and returns its claims and the thumbprint of the key (RFC 7638)
+func verifyDPoPProof(proof string) (dpopClaims, string, error) {
+	var claims dpopClaims
+	msg, err := parseJWS(proof)
+	if err != nil {
+		return claims, "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+	if !strings.EqualFold(headers.Type(), dpopProofType) {
+		return claims, "", fmt.Errorf("%w: typ must be %s", ErrInvalidDPoPProof, dpopProofType)
+	}
+	key := headers.JWK()
+	if key == nil {
+		return claims, "", fmt.Errorf("%w: jwk header is missing", ErrInvalidDPoPProof)
+	}
+	// private keys are rejected by rawPublicKey, symmetric algorithms and 'none' by verifyKeyAlgorithm
+	publicKey, err := rawPublicKey(key)
+	if err != nil {
+		return claims, "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+	if err := verifyKeyAlgorithm(key, headers.Algorithm()); err != nil {
+		return claims, "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+	payload, err := jws.Verify([]byte(proof), headers.Algorithm(), publicKey)
+	if err != nil {
+		return claims, "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return claims, "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+	return claims, base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// validateDPoPClaims checks that the proof was created for this request and access token within Options.DPoPProofWindow
+func (m *Middleware) validateDPoPClaims(r *http.Request, token Token, claims dpopClaims) error {
+	if claims.JwtID == "" {
+		return fmt.Errorf("%w: jti is missing", ErrInvalidDPoPProof)
+	}
+	if claims.HTTPMethod != r.Method {
+		return fmt.Errorf("%w: htm %s does not match the request method %s", ErrInvalidDPoPProof, claims.HTTPMethod, r.Method)
+	}
+	if !matchesRequestURI(claims.HTTPURI, r, m.options.TrustForwardedProto) {
+		return fmt.Errorf("%w: htu %s does not match the request uri", ErrInvalidDPoPProof, claims.HTTPURI)
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if now := m.options.Clock(); claims.IssuedAt == 0 || issuedAt.Before(now.Add(-m.options.DPoPProofWindow)) || issuedAt.After(now.Add(m.options.DPoPProofWindow)) {
+		return fmt.Errorf("%w: iat is not within %v of the current time", ErrInvalidDPoPProof, m.options.DPoPProofWindow)
+	}
+	hash := sha256.Sum256([]byte(token.TokenValue()))
+	if subtle.ConstantTimeCompare([]byte(claims.AccessTokenHash), []byte(base64.RawURLEncoding.EncodeToString(hash[:]))) != 1 {
+		return fmt.Errorf("%w: ath does not match the access token", ErrInvalidDPoPProof)
+	}
+	return nil
+}
+
+// matchesRequestURI compares the htu claim with the request uri without query and fragment, as required by RFC 9449.
+// The scheme is https if the connection uses TLS, or the one of the 'x-forwarded-proto' header if trustForwardedProto is set.
+func matchesRequestURI(htu string, r *http.Request, trustForwardedProto bool) bool {
+	uri, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); trustForwardedProto && proto != "" {
+		scheme = proto
+	}
+	path := uri.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.EqualFold(uri.Scheme, scheme) && strings.EqualFold(uri.Host, r.Host) && path == r.URL.EscapedPath()
+}
@@ -0,0 +1,246 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+const dpopRequestURI = "https://api.example.com/orders"
+
+func TestAuthenticate_dpop(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableDPoP: true})
+	defer middleware.Close()
+
+	clientKey := generateDPoPKey(t)
+	otherKey := generateDPoPKey(t)
+	boundToken := oidcMockServer.MustSignToken(t, map[string]interface{}{
+		"cnf": map[string]interface{}{"jkt": dpopThumbprint(t, clientKey)},
+	})
+	validClaims := func() map[string]interface{} {
+		return dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, time.Now())
+	}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		proof   string
+		wantErr error
+	}{
+		{name: "valid proof", scheme: "DPoP", proof: signDPoPProof(t, clientKey, validClaims())},
+		{name: "case-insensitive scheme", scheme: "dpop", proof: signDPoPProof(t, clientKey, validClaims())},
+		{name: "mismatched jkt", scheme: "DPoP", proof: signDPoPProof(t, otherKey, validClaims()), wantErr: ErrDPoPKeyMismatch},
+		{name: "missing proof", scheme: "DPoP", wantErr: ErrMissingDPoPProof},
+		{name: "bound token as bearer token", scheme: "Bearer", proof: signDPoPProof(t, clientKey, validClaims()), wantErr: ErrMissingDPoPProof},
+		{name: "wrong method", scheme: "DPoP", proof: signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodGet, dpopRequestURI, time.Now())), wantErr: ErrInvalidDPoPProof},
+		{name: "wrong uri", scheme: "DPoP", proof: signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, "https://api.example.com/admin", time.Now())), wantErr: ErrInvalidDPoPProof},
+		{name: "query of uri is ignored", scheme: "DPoP", proof: signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI+"?page=2", time.Now()))},
+		{name: "stale proof", scheme: "DPoP", proof: signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, time.Now().Add(-time.Hour))), wantErr: ErrInvalidDPoPProof},
+		{name: "proof of another token", scheme: "DPoP", proof: signDPoPProof(t, clientKey, dpopProofClaims("other-token", http.MethodPost, dpopRequestURI, time.Now())), wantErr: ErrInvalidDPoPProof},
+		{name: "malformed proof", scheme: "DPoP", proof: "no-jwt", wantErr: ErrInvalidDPoPProof},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := middleware.Authenticate(newDPoPRequest(tt.scheme, boundToken, tt.proof))
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_dpopReplay(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableDPoP: true})
+	defer middleware.Close()
+
+	clientKey := generateDPoPKey(t)
+	boundToken := oidcMockServer.MustSignToken(t, map[string]interface{}{
+		"cnf": map[string]interface{}{"jkt": dpopThumbprint(t, clientKey)},
+	})
+	proof := signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, time.Now()))
+
+	_, err := middleware.Authenticate(newDPoPRequest("DPoP", boundToken, proof))
+	require.NoError(t, err)
+	_, err = middleware.Authenticate(newDPoPRequest("DPoP", boundToken, proof))
+	assert.ErrorIs(t, err, ErrDPoPReplay)
+}
+
+func TestAuthenticate_dpopReplayCacheFull(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableDPoP: true, DPoPReplayCacheMaxSize: 1})
+	defer middleware.Close()
+
+	clientKey := generateDPoPKey(t)
+	boundToken := oidcMockServer.MustSignToken(t, map[string]interface{}{
+		"cnf": map[string]interface{}{"jkt": dpopThumbprint(t, clientKey)},
+	})
+	proof := signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, time.Now()))
+	_, err := middleware.Authenticate(newDPoPRequest("DPoP", boundToken, proof))
+	require.NoError(t, err)
+
+	// the used proof is still valid, it must not be evicted for the next one
+	nextProof := signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, time.Now()))
+	_, err = middleware.Authenticate(newDPoPRequest("DPoP", boundToken, nextProof))
+	assert.ErrorIs(t, err, ErrDPoPReplayCacheFull)
+	_, err = middleware.Authenticate(newDPoPRequest("DPoP", boundToken, proof))
+	assert.ErrorIs(t, err, ErrDPoPReplay)
+
+	// once the used proof expired, the next one is accepted
+	middleware.options.Clock = func() time.Time { return time.Now().Add(2 * defaultDPoPProofWindow) }
+	nextProof = signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, middleware.options.Clock()))
+	_, err = middleware.Authenticate(newDPoPRequest("DPoP", boundToken, nextProof))
+	assert.NoError(t, err)
+}
+
+func TestAuthenticate_dpopForwardedProto(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	clientKey := generateDPoPKey(t)
+	boundToken := oidcMockServer.MustSignToken(t, map[string]interface{}{
+		"cnf": map[string]interface{}{"jkt": dpopThumbprint(t, clientKey)},
+	})
+
+	tests := []struct {
+		name                string
+		requestURI          string
+		forwardedProto      string
+		htu                 string
+		trustForwardedProto bool
+		wantErr             error
+	}{
+		{name: "proxy terminates tls", requestURI: "http://api.example.com/orders", forwardedProto: "https", htu: dpopRequestURI, trustForwardedProto: true},
+		{name: "forwarded proto is not trusted by default", requestURI: "http://api.example.com/orders", forwardedProto: "https", htu: dpopRequestURI, wantErr: ErrInvalidDPoPProof},
+		{name: "forged forwarded proto", requestURI: dpopRequestURI, forwardedProto: "http", htu: "http://api.example.com/orders", wantErr: ErrInvalidDPoPProof},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableDPoP: true, TrustForwardedProto: tt.trustForwardedProto})
+			defer middleware.Close()
+
+			req := httptest.NewRequest(http.MethodPost, tt.requestURI, nil)
+			req.Header.Set("Authorization", "DPoP "+boundToken)
+			req.Header.Set("DPoP", signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, tt.htu, time.Now())))
+			req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			_, err := middleware.Authenticate(req)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_dpopInvalidCnf(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableDPoP: true})
+	defer middleware.Close()
+
+	clientKey := generateDPoPKey(t)
+	boundToken := oidcMockServer.MustSignToken(t, map[string]interface{}{
+		"cnf": map[string]interface{}{"jkt": 1},
+	})
+	proof := signDPoPProof(t, clientKey, dpopProofClaims(boundToken, http.MethodPost, dpopRequestURI, time.Now()))
+
+	_, err := middleware.Authenticate(newDPoPRequest("DPoP", boundToken, proof))
+	assert.ErrorIs(t, err, ErrInvalidCnfClaim)
+	_, err = middleware.Authenticate(newDPoPRequest("Bearer", boundToken, ""))
+	assert.ErrorIs(t, err, ErrInvalidCnfClaim)
+}
+
+func TestAuthenticate_dpopUnboundToken(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableDPoP: true})
+	defer middleware.Close()
+	rawToken := oidcMockServer.MustSignToken(t, nil)
+
+	_, err := middleware.Authenticate(newDPoPRequest("Bearer", rawToken, ""))
+	assert.NoError(t, err, "tokens without cnf jkt must still be accepted as bearer tokens")
+
+	proof := signDPoPProof(t, generateDPoPKey(t), dpopProofClaims(rawToken, http.MethodPost, dpopRequestURI, time.Now()))
+	_, err = middleware.Authenticate(newDPoPRequest("DPoP", rawToken, proof))
+	assert.ErrorIs(t, err, ErrDPoPKeyMismatch)
+}
+
+func TestAuthenticate_dpopDisabled(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+	rawToken := oidcMockServer.MustSignToken(t, nil)
+
+	_, err := middleware.Authenticate(newDPoPRequest("DPoP", rawToken, ""))
+	assert.ErrorIs(t, err, ErrInvalidAuthorizationHeader)
+}
+
+func newDPoPRequest(scheme, rawToken, proof string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, dpopRequestURI, nil)
+	req.Header.Set("Authorization", scheme+" "+rawToken)
+	if proof != "" {
+		req.Header.Set("DPoP", proof)
+	}
+	return req
+}
+
+func generateDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func dpopThumbprint(t *testing.T, key *ecdsa.PrivateKey) string {
+	publicKey, err := jwk.New(&key.PublicKey)
+	require.NoError(t, err)
+	thumbprint, err := publicKey.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(thumbprint)
+}
+
+func dpopProofClaims(rawToken, method, uri string, issuedAt time.Time) map[string]interface{} {
+	hash := sha256.Sum256([]byte(rawToken))
+	return map[string]interface{}{
+		"jti": uuid.New().String(),
+		"htm": method,
+		"htu": uri,
+		"iat": issuedAt.Unix(),
+		"ath": base64.RawURLEncoding.EncodeToString(hash[:]),
+	}
+}
+
+func signDPoPProof(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	publicKey, err := jwk.New(&key.PublicKey)
+	require.NoError(t, err)
+	headers := jws.NewHeaders()
+	require.NoError(t, headers.Set(jws.TypeKey, "dpop+jwt"))
+	require.NoError(t, headers.Set(jws.JWKKey, publicKey))
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	proof, err := jws.Sign(payload, jwa.ES256, key, jws.WithHeaders(headers))
+	require.NoError(t, err)
+	return string(proof)
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const wwwAuthenticate = "WWW-Authenticate"
+
+// Error codes of the WWW-Authenticate header as specified by RFC 6750, section 3.1
+const (
+	BearerErrorInvalidRequest    = "invalid_request"
+	BearerErrorInvalidToken      = "invalid_token"
+	BearerErrorInsufficientScope = "insufficient_scope"
+)
+
+// invalidTokenErrors are described by their own message in the WWW-Authenticate header, any other error is described generically
+var invalidTokenErrors = []error{
+	ErrTokenExpired,
+	ErrTokenNotYetValid,
+	ErrInvalidSignature,
+	ErrUntrustedIssuer,
+	ErrInvalidAudience,
+	ErrAzpMismatch,
+	ErrMissingAlg,
+	ErrDisallowedAlg,
+	ErrKeyNotFound,
+	ErrWeakKey,
+	ErrKeyConstruction,
+	ErrMalformedToken,
+	ErrAuthTooOld,
+	ErrMissingAMR,
+	ErrNotSubscribed,
+	ErrInactiveToken,
+	ErrNonceMismatch,
+	ErrNoClientCert,
+	ErrInvalidCnfClaim,
+	ErrMissingCnfThumbprint,
+	ErrThumbprintMismatch,
+	ErrMissingDPoPProof,
+	ErrInvalidDPoPProof,
+	ErrDPoPKeyMismatch,
+	ErrDPoPReplay,
+	ErrDPoPReplayCacheFull,
+}
+
+// BearerChallenge returns the value of the WWW-Authenticate header for a request which failed to authenticate with err, as specified by RFC 6750.
+// Requests without a token get a challenge without error code, the error description never contains details of the token.
+func BearerChallenge(err error) string {
+	if errors.Is(err, ErrNoToken) {
+		return "Bearer"
+	}
+	return bearerChallenge(bearerError(err))
+}
+
+// bearerError returns the error code of RFC 6750 and a description for err, which never contains details of the token
+func bearerError(err error) (code, description string) {
+	switch {
+	case errors.Is(err, ErrNoToken):
+		return BearerErrorInvalidRequest, ErrNoToken.Error()
+	case errors.Is(err, ErrInsufficientScope):
+		return BearerErrorInsufficientScope, ErrInsufficientScope.Error()
+	case errors.Is(err, ErrInvalidAuthorizationHeader):
+		return BearerErrorInvalidRequest, ErrInvalidAuthorizationHeader.Error()
+	case errors.Is(err, ErrMissingSecondaryToken):
+		return BearerErrorInvalidRequest, ErrMissingSecondaryToken.Error()
+	}
+	for _, invalidTokenErr := range invalidTokenErrors {
+		if errors.Is(err, invalidTokenErr) {
+			return BearerErrorInvalidToken, invalidTokenErr.Error()
+		}
+	}
+	return BearerErrorInvalidToken, "token is invalid"
+}
+
+func bearerChallenge(code, description string) string {
+	return fmt.Sprintf("Bearer error=%q, error_description=%q", code, description)
+}
+
+// ErrorStatusCode returns the HTTP status the DefaultErrorHandler responds with for err:
+// 403 (Forbidden) if the token is valid but lacks a required scope, 401 (Unauthorized) for any authentication failure.
+func ErrorStatusCode(err error) int {
+	if errors.Is(err, ErrInsufficientScope) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// ErrorResponse is the JSON body of the responses of the DefaultErrorHandler, with the error code and description of the WWW-Authenticate header.
+// Requests without token get the error code "invalid_request".
+type ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// NewErrorHandler returns an ErrorHandler which behaves like the DefaultErrorHandler, but responds with the HTTP status returned by statusCode.
+// It allows to customize the mapping of errors to status codes, e.g. by delegating to ErrorStatusCode for all but some errors.
+func NewErrorHandler(statusCode func(err error) int) ErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		code, description := bearerError(err)
+		w.Header().Set(wwwAuthenticate, BearerChallenge(err))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(statusCode(err))
+		_ = json.NewEncoder(w).Encode(ErrorResponse{Error: code, ErrorDescription: description})
+	}
+}
+
+// NewPlainTextErrorHandler returns an ErrorHandler which responds with the HTTP status returned by statusCode and the error message as plain text body,
+// e.g. to opt out of the JSON body of the DefaultErrorHandler. It sets the same WWW-Authenticate header. Note that the body contains the details of err.
+func NewPlainTextErrorHandler(statusCode func(err error) int) ErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		w.Header().Set(wwwAuthenticate, BearerChallenge(err))
+		http.Error(w, err.Error(), statusCode(err))
+	}
+}
@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultErrorHandler_wwwAuthenticate(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "missing token",
+			err:  fmt.Errorf("%w: Authorization header is missing", ErrNoToken),
+			want: `Bearer`,
+		}, {
+			name: "malformed authorization header",
+			err:  fmt.Errorf("extracting token from request header failed: %w", ErrInvalidAuthorizationHeader),
+			want: `Bearer error="invalid_request", error_description="authorization header is not of the form 'Bearer <token>'"`,
+		}, {
+			name: "expired",
+			err:  fmt.Errorf("%w, exp: 2020-01-01", ErrTokenExpired),
+			want: `Bearer error="invalid_token", error_description="token is expired"`,
+		}, {
+			name: "not yet valid",
+			err:  ErrTokenNotYetValid,
+			want: `Bearer error="invalid_token", error_description="token is not valid yet"`,
+		}, {
+			name: "invalid signature",
+			err:  fmt.Errorf("%w: crypto/rsa: verification error", ErrInvalidSignature),
+			want: `Bearer error="invalid_token", error_description="token signature is invalid"`,
+		}, {
+			name: "untrusted issuer",
+			err:  fmt.Errorf("%w: token is unverifiable: unknown server (domain doesn't match)", ErrUntrustedIssuer),
+			want: `Bearer error="invalid_token", error_description="token issuer is not trusted"`,
+		}, {
+			name: "invalid audience",
+			err:  ErrInvalidAudience,
+			want: `Bearer error="invalid_token", error_description="token audience is not accepted"`,
+		}, {
+			name: "disallowed alg",
+			err:  fmt.Errorf("%w: HS256", ErrDisallowedAlg),
+			want: `Bearer error="invalid_token", error_description="alg of jwt header is not allowed"`,
+		}, {
+			name: "insufficient scope",
+			err:  fmt.Errorf("%w: Read", ErrInsufficientScope),
+			want: `Bearer error="insufficient_scope", error_description="token does not provide the required scope"`,
+		}, {
+			name: "unclassified error does not leak details",
+			err:  errors.New(`failed to parse jws: "quoted" details`),
+			want: `Bearer error="invalid_token", error_description="token is invalid"`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			DefaultErrorHandler(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody), tt.err)
+			assert.Equal(t, tt.want, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestDefaultErrorHandler_statusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "missing token", err: ErrNoToken, want: http.StatusUnauthorized},
+		{name: "expired token", err: fmt.Errorf("%w, exp: 2020-01-01", ErrTokenExpired), want: http.StatusUnauthorized},
+		{name: "invalid signature", err: ErrInvalidSignature, want: http.StatusUnauthorized},
+		{name: "insufficient scope", err: fmt.Errorf("%w: Read", ErrInsufficientScope), want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			DefaultErrorHandler(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody), tt.err)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func TestNewErrorHandler(t *testing.T) {
+	handler := NewErrorHandler(func(err error) int {
+		if errors.Is(err, ErrUntrustedIssuer) {
+			return http.StatusForbidden
+		}
+		return ErrorStatusCode(err)
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody), ErrUntrustedIssuer)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody), ErrTokenExpired)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestDefaultErrorHandler_jsonBody(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorResponse
+	}{
+		{
+			name: "missing token",
+			err:  fmt.Errorf("%w: Authorization header is missing", ErrNoToken),
+			want: ErrorResponse{Error: "invalid_request", ErrorDescription: "no token provided in the request"},
+		}, {
+			name: "malformed authorization header",
+			err:  fmt.Errorf("extracting token from request header failed: %w", ErrInvalidAuthorizationHeader),
+			want: ErrorResponse{Error: "invalid_request", ErrorDescription: "authorization header is not of the form 'Bearer <token>'"},
+		}, {
+			name: "expired",
+			err:  fmt.Errorf("%w, exp: 2020-01-01", ErrTokenExpired),
+			want: ErrorResponse{Error: "invalid_token", ErrorDescription: "token is expired"},
+		}, {
+			name: "insufficient scope",
+			err:  fmt.Errorf("%w: Read", ErrInsufficientScope),
+			want: ErrorResponse{Error: "insufficient_scope", ErrorDescription: "token does not provide the required scope"},
+		}, {
+			name: "unclassified error does not leak details",
+			err:  errors.New(`failed to parse jws: "quoted" details`),
+			want: ErrorResponse{Error: "invalid_token", ErrorDescription: "token is invalid"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			DefaultErrorHandler(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody), tt.err)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			var got ErrorResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewPlainTextErrorHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewPlainTextErrorHandler(ErrorStatusCode)(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody), fmt.Errorf("%w, exp: 2020-01-01", ErrTokenExpired))
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "token is expired, exp: 2020-01-01\n", rec.Body.String())
+	assert.Equal(t, `Bearer error="invalid_token", error_description="token is expired"`, rec.Header().Get("WWW-Authenticate"))
+}
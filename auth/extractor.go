@@ -6,21 +6,55 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 )
 
 const authorization string = "Authorization"
 
-func extractRawToken(r *http.Request) (string, error) {
-	authHeader := r.Header.Get(authorization)
+// Errors returned by the token extractors. They are wrapped with additional details, use errors.Is to check for them.
+var (
+	// ErrNoToken distinguishes requests without any token, e.g. to redirect to the login in an ErrorHandler,
+	// from requests with an invalid token or a malformed Authorization header, e.g. to respond with 401.
+	ErrNoToken                    = errors.New("no token provided in the request")
+	ErrInvalidAuthorizationHeader = errors.New("authorization header is not of the form 'Bearer <token>'")
+)
+
+// TokenExtractor is the type for functions which extract the encoded token from a request, see Options.TokenExtractor
+type TokenExtractor func(r *http.Request) (string, error)
+
+// AuthHeaderExtractor extracts the bearer token from the Authorization header. This is the default TokenExtractor.
+// The scheme is case-insensitive and surrounding or repeated whitespace is tolerated, e.g. "bearer  <token>". A header of only whitespace counts as missing.
+func AuthHeaderExtractor(r *http.Request) (string, error) {
+	splitAuthHeader := strings.Fields(r.Header.Get(authorization))
+	if len(splitAuthHeader) == 0 {
+		return "", fmt.Errorf("%w: %s header is missing", ErrNoToken, authorization)
+	}
+	if strings.EqualFold(splitAuthHeader[0], "bearer") && len(splitAuthHeader) == 2 {
+		return splitAuthHeader[1], nil
+	}
 
-	if authHeader != "" {
-		splitAuthHeader := strings.Fields(strings.TrimSpace(authHeader))
-		if strings.EqualFold(splitAuthHeader[0], "bearer") && len(splitAuthHeader) == 2 {
-			return splitAuthHeader[1], nil
+	return "", fmt.Errorf("extracting token from request header failed: %w", ErrInvalidAuthorizationHeader)
+}
+
+// HeaderExtractor returns a TokenExtractor which extracts the plain token from the header with the provided name, e.g. "X-Id-Token"
+func HeaderExtractor(name string) TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		if token := strings.TrimSpace(r.Header.Get(name)); token != "" {
+			return token, nil
 		}
+		return "", fmt.Errorf("%w: extracting token from request header %s failed", ErrNoToken, name)
 	}
+}
 
-	return "", errors.New("extracting token from request header failed")
+// CookieExtractor returns a TokenExtractor which extracts the token from the cookie with the provided name
+func CookieExtractor(name string) TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", fmt.Errorf("%w: extracting token from request cookie %s failed", ErrNoToken, name)
+		}
+		return cookie.Value, nil
+	}
 }
@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwt/openid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	claimActive      = "active"
+	claimClientID    = "client_id"
+	maxResponseBytes = 1 << 20 // 1 MiB, like the limit of the discovery and JWKs responses
+)
+
+// introspectionResult is the cached outcome of an introspection, i.e. the Token of an active or the error of an inactive opaque token
+type introspectionResult struct {
+	token Token
+	err   error
+}
+
+// introspect validates an opaque token with the introspection endpoint (RFC 7662), see Options.EnableIntrospection.
+// The claims of the introspection response, e.g. 'sub', 'scope' or 'exp', are returned as claims of the Token.
+// Active results are cached until their 'exp', at most for Options.IntrospectionCacheTTL, inactive ones for Options.InactiveTokenCacheTTL.
+func (m *Middleware) introspect(ctx context.Context, rawToken string) (_ Token, err error) {
+	ctx, span := m.tracer.Start(ctx, "auth.introspect")
+	defer func() { endSpan(span, err) }()
+
+	key := tokenCacheKey(rawToken)
+	now := m.options.Clock()
+	entry, cachedUntil, found := m.introspections.get(key)
+	hit := found && now.Before(cachedUntil)
+	m.introspections.recordLookup(hit)
+	var token Token
+	if hit {
+		span.SetAttributes(attribute.Bool("cached", true))
+		result := entry.(*introspectionResult)
+		token, err = result.token, result.err
+	} else {
+		token, err = m.requestIntrospection(ctx, rawToken)
+		switch {
+		case err == nil:
+			expiry := now.Add(m.options.IntrospectionCacheTTL)
+			if _, hasExp := token.getJwtToken().Get(openid.ExpirationKey); hasExp && token.Expiration().Before(expiry) {
+				expiry = token.Expiration()
+			}
+			m.introspections.set(key, &introspectionResult{token: token}, expiry)
+		case errors.Is(err, ErrInactiveToken), errors.Is(err, ErrTokenExpired):
+			m.introspections.set(key, &introspectionResult{err: err}, now.Add(m.options.InactiveTokenCacheTTL))
+		}
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	// checked on every use, as the expected audiences depend on the context
+	if err := m.validateIntrospectedAudience(ctx, token); err != nil {
+		return Token{}, err
+	}
+	return token, nil
+}
+
+// validateIntrospectedAudience applies the audience checks of jwts to the active introspection result, which is accepted for its 'aud' or 'client_id'.
+// The introspection endpoint is the one of the identity, so the client ids of the identities for its domain are accepted.
+func (m *Middleware) validateIntrospectedAudience(ctx context.Context, token Token) error {
+	audiences := append([]string{}, token.Audience()...)
+	if clientID, err := token.GetClaimAsString(claimClientID); err == nil && clientID != "" {
+		audiences = append(audiences, clientID)
+	}
+	return m.validateAudience(ctx, token, audiences, m.clientIDsOfIssuer(m.identity.GetURL()))
+}
+
+// requestIntrospection performs the introspection request for the opaque token
+func (m *Middleware) requestIntrospection(ctx context.Context, rawToken string) (Token, error) {
+	introspectionURL, err := m.introspectionURL(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	data := url.Values{}
+	data.Set("token", rawToken)
+	data.Set("token_type_hint", "access_token")
+	data.Set("client_id", m.identity.GetClientID())
+	if m.identity.GetClientSecret() != "" {
+		data.Set("client_secret", m.identity.GetClientSecret())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, introspectionURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return Token{}, fmt.Errorf("unable to construct introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.options.HTTPClient.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("token is unverifiable: unable to perform introspection request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes+1))
+	if err != nil {
+		return Token{}, fmt.Errorf("token is unverifiable: unable to read introspection response: %w", err)
+	}
+	if len(body) > maxResponseBytes {
+		return Token{}, fmt.Errorf("token is unverifiable: introspection response exceeds %d bytes", maxResponseBytes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// the payload might echo details of the request, it is logged only
+		m.options.Logger.Error("introspection request failed", "url", introspectionURL, "status", resp.StatusCode, "payload", string(body))
+		return Token{}, fmt.Errorf("token is unverifiable: introspection request failed with status code '%d'", resp.StatusCode)
+	}
+
+	claims := openid.New()
+	if err := json.Unmarshal(body, claims); err != nil {
+		return Token{}, fmt.Errorf("token is unverifiable: unable to parse introspection response: %w", err)
+	}
+	if active, _ := claims.Get(claimActive); active != true {
+		return Token{}, ErrInactiveToken
+	}
+	_ = claims.Remove(claimActive)
+
+	token := Token{encodedToken: rawToken, jwtToken: claims}
+	m.bindToken(&token)
+	if _, hasExp := claims.Get(openid.ExpirationKey); hasExp && token.IsExpired() {
+		return Token{}, fmt.Errorf("%w: introspected token expired at %v", ErrTokenExpired, token.Expiration())
+	}
+	return token, nil
+}
+
+// introspectionURL returns Options.IntrospectionURL or the discovered introspection endpoint of the identity, which must be in its domains
+func (m *Middleware) introspectionURL(ctx context.Context) (string, error) {
+	if m.options.IntrospectionURL != "" {
+		return m.options.IntrospectionURL, nil
+	}
+	oidcTenant, err := m.getOIDCTenant(ctx, m.identity.GetURL(), "")
+	if err != nil {
+		return "", err
+	}
+	if oidcTenant.ProviderJSON.IntrospectionURL == "" {
+		return "", fmt.Errorf("token is unverifiable: issuer %s provides no introspection endpoint", m.identity.GetURL())
+	}
+	// the client secret is sent to the endpoint, a tampered discovery must not redirect it outside of the trusted domains
+	if err := m.verifyEndpointURL(m.identity.GetURL(), oidcTenant.ProviderJSON.IntrospectionURL); err != nil {
+		return "", fmt.Errorf("token is unverifiable: %w", err)
+	}
+	return oidcTenant.ProviderJSON.IntrospectionURL, nil
+}
@@ -0,0 +1,252 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/env"
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+// newIntrospectionServer serves introspection responses for the opaque tokens "active-token", "expired-token", "foreign-token" of another client
+// and "oversized-token" with a body exceeding the size limit, any other token is inactive.
+// The server counts its requests in hits.
+// introspectedExpiry is the 'exp' of the active introspection response
+var introspectedExpiry = time.Now().Add(time.Hour)
+
+func newIntrospectionServer(t *testing.T, config *mocks.MockConfig, hits *int32) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits != nil {
+			atomic.AddInt32(hits, 1)
+		}
+		if r.PostFormValue("client_id") != config.ClientID || r.PostFormValue("client_secret") != config.ClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "active-token":
+			response = map[string]interface{}{"active": true, "sub": "john.doe", "scope": "read write", "client_id": config.ClientID, "exp": introspectedExpiry.Unix()}
+		case "expired-token":
+			response = map[string]interface{}{"active": true, "sub": "john.doe", "exp": time.Now().Add(-time.Hour).Unix()}
+		case "foreign-token":
+			response = map[string]interface{}{"active": true, "sub": "john.doe", "aud": "other-client", "client_id": "other-client", "exp": introspectedExpiry.Unix()}
+		case "oversized-token":
+			response = map[string]interface{}{"active": true, "padding": strings.Repeat("a", maxResponseBytes)}
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestValidateToken_introspection(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	introspectionServer := newIntrospectionServer(t, oidcMockServer.Config, nil)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:          oidcMockServer.Server.Client(),
+		EnableIntrospection: true,
+		IntrospectionURL:    introspectionServer.URL,
+	})
+	defer middleware.Close()
+
+	tests := []struct {
+		name     string
+		rawToken string
+		wantErr  error
+	}{
+		{name: "active token", rawToken: "active-token"},
+		{name: "inactive token", rawToken: "revoked-token", wantErr: ErrInactiveToken},
+		{name: "expired token", rawToken: "expired-token", wantErr: ErrTokenExpired},
+		{name: "token of another client", rawToken: "foreign-token", wantErr: ErrInvalidAudience},
+		{name: "jwt is still verified locally", rawToken: oidcMockServer.MustSignToken(t, nil)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := middleware.ValidateToken(context.Background(), tt.rawToken)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("claims of the introspection response", func(t *testing.T) {
+		token, err := middleware.ValidateToken(context.Background(), "active-token")
+		require.NoError(t, err)
+		assert.Equal(t, "active-token", token.TokenValue())
+		assert.Equal(t, "john.doe", token.Subject())
+		assert.True(t, token.HasScope("write"))
+		assert.False(t, token.HasClaim(claimActive))
+	})
+}
+
+func TestValidateToken_introspectionAudience(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	introspectionServer := newIntrospectionServer(t, oidcMockServer.Config, nil)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:          oidcMockServer.Server.Client(),
+		EnableIntrospection: true,
+		IntrospectionURL:    introspectionServer.URL,
+		AcceptedAudiences:   []string{"other-client"},
+	})
+	defer middleware.Close()
+
+	_, err := middleware.ValidateToken(context.Background(), "foreign-token")
+	assert.NoError(t, err, "client id of the result is an accepted audience")
+
+	_, err = middleware.ValidateToken(WithExpectedAudiences(context.Background(), "orders-api"), "foreign-token")
+	assert.ErrorIs(t, err, ErrInvalidAudience, "cached result must be checked against the audiences of the context")
+}
+
+func TestValidateToken_introspectionResponseTooLarge(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	introspectionServer := newIntrospectionServer(t, oidcMockServer.Config, nil)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:          oidcMockServer.Server.Client(),
+		EnableIntrospection: true,
+		IntrospectionURL:    introspectionServer.URL,
+	})
+	defer middleware.Close()
+
+	_, err := middleware.ValidateToken(context.Background(), "oversized-token")
+	assert.ErrorContains(t, err, "introspection response exceeds")
+}
+
+func TestValidateToken_introspectionMalformedJWT(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	var hits int32
+	introspectionServer := newIntrospectionServer(t, oidcMockServer.Config, &hits)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:          oidcMockServer.Server.Client(),
+		EnableIntrospection: true,
+		IntrospectionURL:    introspectionServer.URL,
+	})
+	defer middleware.Close()
+
+	_, err := middleware.ValidateToken(context.Background(), "not.a.jwt")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInactiveToken)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits), "malformed jwts must not be sent to the introspection endpoint")
+}
+
+func TestValidateToken_introspectionDisabled(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	_, err := middleware.ValidateToken(context.Background(), "active-token")
+	assert.ErrorIs(t, err, ErrMalformedToken)
+}
+
+func TestValidateToken_introspectionEndpointNotDiscovered(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableIntrospection: true})
+	defer middleware.Close()
+
+	_, err := middleware.ValidateToken(context.Background(), "active-token")
+	assert.ErrorContains(t, err, "provides no introspection endpoint")
+}
+
+func TestValidateToken_introspectionEndpointOfDiscovery(t *testing.T) {
+	tests := []struct {
+		name             string
+		introspectionURL func(serverURL string) string
+		wantErr          error
+	}{
+		{name: "endpoint of the trusted domain", introspectionURL: func(serverURL string) string { return serverURL + "/introspect" }},
+		{name: "cross-domain endpoint", introspectionURL: func(string) string { return "https://attacker.example.com/introspect" }, wantErr: ErrUntrustedEndpoint},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var server *httptest.Server
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/introspect" {
+					_, _ = w.Write([]byte(`{"active":true,"sub":"john.doe","client_id":"clientid"}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"issuer":"` + server.URL + `","jwks_uri":"` + server.URL + `/oauth2/certs","introspection_endpoint":"` + tt.introspectionURL(server.URL) + `"}`))
+			}))
+			defer server.Close()
+			serverURL, _ := url.Parse(server.URL)
+			middleware := NewMiddleware(env.DefaultIdentity{ClientID: "clientid", ClientSecret: "secret", URL: server.URL, Domains: []string{serverURL.Host}},
+				Options{HTTPClient: server.Client(), EnableIntrospection: true})
+			defer middleware.Close()
+
+			_, err := middleware.ValidateToken(context.Background(), "active-token")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateToken_introspectionCache(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	var hits int32
+	introspectionServer := newIntrospectionServer(t, oidcMockServer.Config, &hits)
+	now := time.Now()
+	middleware := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:          oidcMockServer.Server.Client(),
+		EnableIntrospection: true,
+		IntrospectionURL:    introspectionServer.URL,
+		Clock:               func() time.Time { return now },
+	})
+	defer middleware.Close()
+
+	validate := func(rawToken string) error {
+		_, err := middleware.ValidateToken(context.Background(), rawToken)
+		return err
+	}
+
+	t.Run("active token", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		require.NoError(t, validate("active-token"))
+		require.NoError(t, validate("active-token"))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "second validation within the cache window must not be introspected")
+	})
+	t.Run("inactive token", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		assert.ErrorIs(t, validate("revoked-token"), ErrInactiveToken)
+		assert.ErrorIs(t, validate("revoked-token"), ErrInactiveToken)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+		now = now.Add(defaultInactiveTokenCacheTTL)
+		assert.ErrorIs(t, validate("revoked-token"), ErrInactiveToken)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "inactive results are cached briefly only")
+	})
+	t.Run("expired cache entry", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		now = now.Add(defaultIntrospectionCacheTTL)
+		require.NoError(t, validate("active-token"))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "active results are cached at most for the IntrospectionCacheTTL")
+	})
+	t.Run("cached until exp", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		middleware.ClearCache()
+		now = introspectedExpiry.Add(-time.Minute)
+		require.NoError(t, validate("active-token"))
+		now = introspectedExpiry
+		_ = validate("active-token")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "active results are not cached beyond their exp")
+	})
+}
@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+// Logger is the interface for structured logging of the Middleware, see Options.Logger.
+// kv holds alternating keys and values, e.g. "issuer", "https://mytenant.accounts.ondemand.com"
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// noopLogger is the default Logger which discards all events
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...interface{}) {}
+
+func (noopLogger) Error(string, ...interface{}) {}
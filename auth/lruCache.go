@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCacheFull is returned by lruCache.add if the cache contains maxSize entries which have not expired yet
+var errCacheFull = errors.New("cache is full")
+
+// lruCache is a size-bounded cache with expiring entries. If the cache is full, set evicts the least recently used entry, see add for the exception.
+// It is safe for concurrent use.
+type lruCache struct {
+	maxSize int // maxSize is the maximum number of entries, 0 disables the bound
+	entries map[string]*list.Element
+	lru     *list.List // contains *lruEntry, the most recently used first
+	mu      sync.Mutex
+
+	hits, misses, evictions uint64 // hits, misses and evictions are counted for CacheStats, guarded by mu
+}
+
+type lruEntry struct {
+	key    string
+	value  interface{}
+	expiry time.Time
+}
+
+func newLRUCache(maxSize int) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the value and expiry of key and marks it as recently used. Expired entries are returned as well, the caller decides about their use.
+func (c *lruCache) get(key string) (interface{}, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return nil, time.Time{}, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*lruEntry)
+	return entry.value, entry.expiry, true
+}
+
+// set adds or replaces the value of key and evicts the least recently used entries above maxSize
+func (c *lruCache) set(key string, value interface{}, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.removeElement(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&lruEntry{key: key, value: value, expiry: expiry})
+	for c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		c.removeElement(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// add adds the value of key unless the key is cached and not expired at now. It returns false if the key is already present.
+// Unlike a get followed by set, the check and the insertion are atomic. Unlike set, add never evicts entries which have not expired at now,
+// e.g. so that a full cache of used DPoP proofs does not forget proofs which are still valid. It returns errCacheFull instead.
+func (c *lruCache) add(key string, value interface{}, expiry, now time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		if !now.After(elem.Value.(*lruEntry).expiry) {
+			return false, nil
+		}
+		c.removeElement(elem)
+	}
+	if c.maxSize > 0 && c.lru.Len() >= c.maxSize {
+		c.removeExpired(now)
+		if c.lru.Len() >= c.maxSize {
+			return false, errCacheFull
+		}
+	}
+	c.entries[key] = c.lru.PushFront(&lruEntry{key: key, value: value, expiry: expiry})
+	return true, nil
+}
+
+// delete removes the entry of key, if any
+func (c *lruCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.removeElement(elem)
+	}
+}
+
+// deleteExpired removes all entries which expired before now
+func (c *lruCache) deleteExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired(now)
+}
+
+// values returns a snapshot of all values without changing their recent use
+func (c *lruCache) values() []interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make([]interface{}, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		values = append(values, elem.Value.(*lruEntry).value)
+	}
+	return values
+}
+
+// flush removes all entries
+func (c *lruCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// len returns the number of entries
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// recordLookup counts a lookup as hit or miss. It is up to the caller, as only the caller knows whether a found entry was usable, e.g. not expired.
+func (c *lruCache) recordLookup(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// stats returns the number of entries and the lookups and evictions counted since the cache was created, flush does not reset the counters
+func (c *lruCache) stats() CacheCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheCounts{Entries: c.lru.Len(), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+func (c *lruCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*lruEntry).key)
+}
+
+// removeExpired removes all entries which expired before now. The caller must hold the lock.
+func (c *lruCache) removeExpired(now time.Time) {
+	for _, elem := range c.entries {
+		if now.After(elem.Value.(*lruEntry).expiry) {
+			c.removeElement(elem)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+// Outcomes of token validations reported to the MetricsRecorder
+const (
+	OutcomeSuccess          = "success"
+	OutcomeExpired          = "expired"
+	OutcomeNotYetValid      = "not_yet_valid"
+	OutcomeInvalidSignature = "invalid_signature"
+	OutcomeUntrustedIssuer  = "untrusted_issuer"
+	OutcomeInvalidAudience  = "invalid_audience"
+	OutcomeDisallowedAlg    = "disallowed_alg"
+	OutcomeKeyNotFound      = "key_not_found"
+	OutcomeWeakKey          = "weak_key"
+	OutcomeFailure          = "failure"
+)
+
+// MetricsRecorder is the interface to collect metrics of the Middleware, see Options.MetricsRecorder.
+// It keeps the library independent of a specific metrics library, e.g. it can be implemented with prometheus/client_golang.
+type MetricsRecorder interface {
+	IncValidation(outcome string)              // IncValidation counts a token validation, see OutcomeSuccess and related outcomes
+	ObserveValidationDuration(d time.Duration) // ObserveValidationDuration records the latency of a token validation
+	IncDiscovery(outcome string)               // IncDiscovery counts an OIDC discovery, outcome is either OutcomeSuccess or OutcomeFailure
+	ObserveDiscoveryDuration(d time.Duration)  // ObserveDiscoveryDuration records the latency of an OIDC discovery
+	IncJWKsRefresh()                           // IncJWKsRefresh counts forced JWKs fetches, e.g. after a key rotation
+	IncCacheLookup(hit bool)                   // IncCacheLookup counts lookups of the OIDC tenant cache, expired or outdated tenants are no hit
+}
+
+// noopMetricsRecorder is the default MetricsRecorder which discards all metrics
+type noopMetricsRecorder struct{}
+
+func (noopMetricsRecorder) IncValidation(string) {}
+
+func (noopMetricsRecorder) ObserveValidationDuration(time.Duration) {}
+
+func (noopMetricsRecorder) IncDiscovery(string) {}
+
+func (noopMetricsRecorder) ObserveDiscoveryDuration(time.Duration) {}
+
+func (noopMetricsRecorder) IncJWKsRefresh() {}
+
+func (noopMetricsRecorder) IncCacheLookup(bool) {}
+
+// validationOutcome maps the validation error to the outcome reported to the MetricsRecorder
+func validationOutcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, ErrTokenExpired):
+		return OutcomeExpired
+	case errors.Is(err, ErrTokenNotYetValid):
+		return OutcomeNotYetValid
+	case errors.Is(err, ErrInvalidSignature):
+		return OutcomeInvalidSignature
+	case errors.Is(err, ErrUntrustedIssuer):
+		return OutcomeUntrustedIssuer
+	case errors.Is(err, ErrInvalidAudience):
+		return OutcomeInvalidAudience
+	case errors.Is(err, ErrDisallowedAlg), errors.Is(err, ErrMissingAlg):
+		return OutcomeDisallowedAlg
+	case errors.Is(err, ErrKeyNotFound):
+		return OutcomeKeyNotFound
+	case errors.Is(err, ErrWeakKey):
+		return OutcomeWeakKey
+	default:
+		return OutcomeFailure
+	}
+}
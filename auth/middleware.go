@@ -6,15 +6,28 @@ package auth
 
 import (
 	"context"
-	"log"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/patrickmn/go-cache"
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/singleflight"
 
 	"github.com/sap/cloud-security-client-go/env"
 	"github.com/sap/cloud-security-client-go/httpclient"
+	"github.com/sap/cloud-security-client-go/oidcclient"
 	"github.com/sap/cloud-security-client-go/tokenclient"
 )
 
@@ -24,27 +37,133 @@ type ContextKey int
 // TokenCtxKey is the key that holds the authorization value (*OIDCClaims) in the request context
 // ClientCertificateCtxKey is the key that holds the x509 client certificate in the request context
 const (
-	TokenCtxKey             ContextKey = 0
-	ClientCertificateCtxKey ContextKey = 1
-	cacheExpiration                    = 12 * time.Hour
-	cacheCleanupInterval               = 24 * time.Hour
+	TokenCtxKey                     ContextKey = 0
+	ClientCertificateCtxKey         ContextKey = 1
+	expectedAudiencesCtxKey         ContextKey = 2
+	cacheExpiration                            = 12 * time.Hour
+	cacheCleanupInterval                       = 24 * time.Hour
+	defaultMaxTenants                          = 1000
+	defaultDiscoveryFailureCooldown            = 10 * time.Second
+	discoveryTimeout                           = 30 * time.Second
+	defaultDiscoveryRetries                    = 2
+	defaultDiscoveryRetryBaseDelay             = 100 * time.Millisecond
+	defaultMinRSAKeyBits                       = 2048
+	defaultJWKsFetchBurst                      = 10
+	defaultJWKsFetchInterval                   = 6 * time.Second
+	defaultKeyRefreshLeadTime                  = 1 * time.Minute
+	defaultClockSkew                           = 1 * time.Minute
+	defaultIntrospectionCacheTTL               = 5 * time.Minute
+	defaultInactiveTokenCacheTTL               = 10 * time.Second
+	defaultDPoPProofWindow                     = 1 * time.Minute
+	minSymmetricKeyBytes                       = 32 // RFC 7518 requires a key of at least the hash output size, i.e. 256 bits for HS256
 )
 
-// ErrorHandler is the type for the Error Handler which is called on unsuccessful token validation and if the AuthenticationHandler middleware func is used
+// ErrInvalidConfig is returned by Options.Validate and raised by NewMiddleware for incomplete or inconsistent configuration
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ErrorHandler is the type for the Error Handler which is called on unsuccessful token validation and if the AuthenticationHandler middleware func is used.
+// It receives the original request and the error, which wraps the typed errors of this package, e.g. ErrTokenExpired, use errors.Is to check for them.
+// The handler is responsible to write the complete response to w, the request is not passed to the next handler afterwards.
 type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
 
+// KeyFunc returns the key to verify the signature of the parsed, but not yet validated token, see Options.KeyFunc.
+// The 'alg' of the token is checked against Options.AllowedAlgorithms before. An error fails the validation with ErrKeyNotFound.
+// As no discovery is performed, the 'iss' claim is not compared to a discovered issuer and cached tokens are not verified again if the keys change.
+type KeyFunc func(ctx context.Context, token Token) (jwk.Key, error)
+
+// SubscriptionFunc reports whether the consumer tenant with the tenantID, i.e. Token.AppTID, is subscribed to the application, see Options.IsSubscribed
+type SubscriptionFunc func(tenantID string) bool
+
 // Options can be used as a argument to instantiate a AuthMiddle with NewMiddleware.
 type Options struct {
-	ErrorHandler ErrorHandler // ErrorHandler called if the jwt verification fails and the AuthenticationHandler middleware func is used. Default: DefaultErrorHandler
-	HTTPClient   *http.Client // HTTPClient which is used for OIDC discovery and to retrieve JWKs (JSON Web Keys). Default: basic http.Client with a timeout of 15 seconds
+	ErrorHandler                 ErrorHandler             // ErrorHandler called if the jwt verification fails and the AuthenticationHandler middleware func is used. Default (also if nil): DefaultErrorHandler
+	HTTPClient                   *http.Client             // HTTPClient which is used for OIDC discovery and to retrieve JWKs (JSON Web Keys). Default: httpclient.DefaultHTTPClient with a timeout of 10 seconds
+	TLSConfig                    *tls.Config              // TLSConfig is used by the default HTTPClient, e.g. to trust the root CA of a corporate proxy or to present a client certificate. If it provides no certificate, the one of a cert-based identity is presented. It must not be combined with HTTPClient. Default: system roots
+	AllowedAlgorithms            []jwa.SignatureAlgorithm // AllowedAlgorithms restricts the accepted 'alg' header values of the token. Default: RS256, ES256, ES384, ES512, PS256, PS384, PS512
+	TokenExtractor               TokenExtractor           // TokenExtractor extracts the encoded token from the request, e.g. CookieExtractor. Default: AuthHeaderExtractor
+	SecondaryTokenExtractor      TokenExtractor           // SecondaryTokenExtractor extracts a second token which must be valid as well, e.g. HeaderExtractor("X-Xsuaa-Token"). It is available with Token.SecondaryToken. Default: none, i.e. a single token
+	SecondaryTokenValidator      TokenValidator           // SecondaryTokenValidator validates the secondary token, e.g. the ValidateToken method of a Middleware for another identity. Default: ValidateToken of this Middleware
+	Logger                       Logger                   // Logger receives structured events, e.g. about performed discoveries and failed validations. Default: no logging
+	TracerProvider               trace.TracerProvider     // TracerProvider creates the OpenTelemetry spans of token validations and discoveries. Default: the global otel.GetTracerProvider(), a no-op unless configured
+	MetricsRecorder              MetricsRecorder          // MetricsRecorder collects metrics about validations and discoveries. Default: no metrics
+	SkipPaths                    []string                 // SkipPaths are served by the AuthenticationHandler without authentication, e.g. "/health". Paths ending with "*" match as prefix, e.g. "/metrics/*"
+	AllowAnonymous               bool                     // AllowAnonymous lets the AuthenticationHandler serve requests without token anonymously, i.e. without Token in the context, see ClaimsFromContext. Requests with an invalid token are still rejected. Default: false
+	EnableBackgroundKeyRefresh   bool                     // EnableBackgroundKeyRefresh refreshes cached JWKs in a goroutine before they expire, stop it with Middleware.Close. Default: false
+	BackgroundKeyRefreshLeadTime time.Duration            // BackgroundKeyRefreshLeadTime is the time before expiry at which JWKs are refreshed in the background. Default: 1 minute
+	AdditionalIdentities         []env.Identity           // AdditionalIdentities are further IAS tenants whose tokens are accepted, e.g. at a gateway. A token is validated against the identities whose domains match its issuer, i.e. their client ids are accepted as audience. Default: none
+	IsSubscribed                 SubscriptionFunc         // IsSubscribed restricts tokens of consumer tenants to subscribed ones in multi-tenant applications, see Token.AppTID. Tokens of the provider tenant, i.e. the zone of the identity, are always accepted. Default: tokens of all tenants of the trusted domains are accepted
+	AcceptedAudiences            []string                 // AcceptedAudiences are accepted as 'aud' of the token in addition to the client id of the identity, e.g. client ids of further bindings. Default: client id only
+	SkipAudienceValidation       bool                     // SkipAudienceValidation accepts tokens issued for any audience of the trusted issuer, e.g. at an API gateway. Only set it if the audience is validated downstream. Default: false
+	VerifyAzp                    bool                     // VerifyAzp requires the 'azp' claim of tokens with multiple audiences to be the client id of the identity, as recommended by OIDC. Default: false
+	MaxAuthAge                   time.Duration            // MaxAuthAge rejects tokens with ErrAuthTooOld if the user authenticated longer ago according to the 'auth_time' claim, e.g. to require a recent login for sensitive operations. Default: 0, i.e. no check
+	RequiredAMR                  []string                 // RequiredAMR rejects tokens with ErrMissingAMR if their 'amr' claim lacks any of the authentication methods, e.g. "mfa" to require multi-factor authentication. Default: none
+	RequiredScopes               []string                 // RequiredScopes must all be granted by a valid token, otherwise the request is rejected with ErrInsufficientScope, i.e. 403 by the DefaultErrorHandler. Default: none
+	XSAppName                    string                   // XSAppName is the prefix of the XSUAA scopes of the application, e.g. env.XSUAAConfig.XSAppName, see Token.HasLocalScope. Default: none
+	Clock                        func() time.Time         // Clock returns the current time used to validate the token and to expire cached discovery results and JWKs, e.g. to freeze time in tests. Default: time.Now
+	ClockSkew                    time.Duration            // ClockSkew is the leeway for the 'exp', 'nbf' and 'iat' claims and Token.IsExpired to tolerate clock differences to the issuer, a negative value disables it. Default: 1 minute
+	EnableTokenCache             bool                     // EnableTokenCache caches validated tokens until their expiry to skip repeated signature verifications of the same token. Default: false
+	TokenCacheMaxSize            int                      // TokenCacheMaxSize is the maximum number of cached tokens and introspection results, the least recently used token is evicted first. Default: 1000
+	MaxTenants                   int                      // MaxTenants is the maximum number of cached OIDC tenants including their JWKs, the least recently used tenant is evicted first. Default: 1000
+	DiscoveryFailureCooldown     time.Duration            // DiscoveryFailureCooldown is the time a failed OIDC discovery is cached, tokens of the issuer fail fast meanwhile. Default: 10 seconds
+	DiscoveryRetries             int                      // DiscoveryRetries is the number of retries of discovery and JWKs requests on connection errors, 429 and 5xx responses, a negative value disables retries. Default: 2
+	DiscoveryRetryBaseDelay      time.Duration            // DiscoveryRetryBaseDelay is the backoff before the first retry, it doubles with every further retry and is randomized by a jitter. Default: 100 milliseconds
+	DiscoveryMaxRetryAfter       time.Duration            // DiscoveryMaxRetryAfter caps the delay requested by the Retry-After header of 429 and 503 responses, which is waited for instead of the backoff. Default: 10 seconds
+	MinRSAKeyBits                int                      // MinRSAKeyBits is the minimum modulus size of RSA keys, tokens verified by smaller keys are rejected with ErrWeakKey. Default: 2048
+	EnableProofOfPossession      bool                     // EnableProofOfPossession requires the 'cnf' claim 'x5t#S256' of the token to match the thumbprint of the client certificate of the TLS connection, or of the 'x-forwarded-client-cert' header if TrustForwardedClientCert is set. Default: false
+	TrustForwardedClientCert     bool                     // TrustForwardedClientCert reads the client certificate of requests without TLS from the 'x-forwarded-client-cert' header. Only set it if a proxy terminates TLS and always overwrites the header, as clients can forge it otherwise. Default: false
+	EnableDPoP                   bool                     // EnableDPoP accepts tokens with the 'DPoP' Authorization scheme (RFC 9449). Tokens with the 'cnf' claim 'jkt' require a DPoP proof of the bound key for the request method and uri. Default: false
+	DPoPProofWindow              time.Duration            // DPoPProofWindow is the maximum difference between the 'iat' of a DPoP proof and the current time, reused proofs are rejected within the window. Default: 1 minute
+	DPoPReplayCacheMaxSize       int                      // DPoPReplayCacheMaxSize is the maximum number of used DPoP proofs remembered within the DPoPProofWindow to reject their reuse. Further proofs are rejected with ErrDPoPReplayCacheFull. Default: 10000
+	TrustForwardedProto          bool                     // TrustForwardedProto checks the 'htu' of DPoP proofs against the scheme of the 'x-forwarded-proto' header instead of the connection. Only set it if a proxy terminates TLS and always overwrites the header. Default: false
+	JWKsURL                      string                   // JWKsURL is used to fetch the JWKs of all issuers instead of the 'jwks_uri' of the discovery, e.g. a cached mirror. The issuer is still discovered. Default: the discovered 'jwks_uri'
+	DiscoveryPath                string                   // DiscoveryPath is the path of the OIDC discovery document on the host of the issuer, e.g. for proxies which serve it elsewhere. It must start with '/'. Default: /.well-known/openid-configuration
+	KeyFunc                      KeyFunc                  // KeyFunc resolves the verification key of tokens instead of the OIDC discovery and JWKs, e.g. from an HSM. The domain of the issuer is still verified. Default: JWKs of the discovery
+	SymmetricKey                 []byte                   // SymmetricKey is the shared secret of at least 32 bytes to verify HMAC signed tokens, e.g. HS256 tokens of internal services. HS256 must be added to AllowedAlgorithms as well. Default: none, i.e. HMAC signed tokens are rejected
+	SymmetricKeyIssuer           string                   // SymmetricKeyIssuer is the 'iss' of tokens verified with the SymmetricKey, it must not be an issuer which publishes JWKs. Its tokens are accepted for the client id of the identity. Required with SymmetricKey
+	JWKsFetchBurst               int                      // JWKsFetchBurst is the number of JWKs fetches per issuer allowed at once, e.g. for unknown zones or key ids. If exceeded, the cached keys are used or the validation fails fast. Default: 10
+	JWKsFetchInterval            time.Duration            // JWKsFetchInterval is the time after which one more JWKs fetch per issuer is allowed again, up to JWKsFetchBurst. Default: 6 seconds
+	MinJWKsCacheTTL              time.Duration            // MinJWKsCacheTTL is the shortest time JWKs are cached, even if the 'max-age' of the Cache-Control header of the JWKs response is shorter or 'no-cache'. Default: 1 minute
+	MaxJWKsCacheTTL              time.Duration            // MaxJWKsCacheTTL is the longest time JWKs are cached, even if the 'max-age' of the JWKs response is longer. Without 'max-age', JWKs are cached for 15 minutes. Default: 24 hours
+	EnableIntrospection          bool                     // EnableIntrospection validates tokens which are no JWT, i.e. opaque tokens, with the introspection endpoint (RFC 7662) using the client credentials of the identity. Only tokens reported as active are accepted. Default: false
+	IntrospectionURL             string                   // IntrospectionURL is used to introspect opaque tokens if EnableIntrospection is set. Default: the 'introspection_endpoint' of the discovery of the identity
+	IntrospectionCacheTTL        time.Duration            // IntrospectionCacheTTL is the maximum time active introspection results are cached, they expire earlier at the 'exp' of the response. Default: 5 minutes
+	InactiveTokenCacheTTL        time.Duration            // InactiveTokenCacheTTL is the time inactive introspection results are cached, so that repeated requests with a revoked token fail fast. Default: 10 seconds
 }
 
 // TokenFromCtx retrieves the claims of a request which
-// have been injected before via the auth middleware
+// have been injected before via the auth middleware. It panics if no claims are injected, prefer ClaimsFromContext.
 func TokenFromCtx(r *http.Request) Token {
 	return r.Context().Value(TokenCtxKey).(Token)
 }
 
+// ClaimsFromContext retrieves the claims (Token) which have been injected before into the context, e.g. via the AuthenticationHandler middleware or the grpcauth interceptors.
+// The encoded token, e.g. to forward it for a token exchange, is returned by Token.TokenValue. Returns false, if the context holds no Token.
+func ClaimsFromContext(ctx context.Context) (Token, bool) {
+	token, ok := ctx.Value(TokenCtxKey).(Token)
+	return token, ok
+}
+
+// NewContext returns a copy of parent which carries the token, e.g. to propagate the validated claims to internal service calls.
+// The token is retrieved with ClaimsFromContext.
+func (t Token) NewContext(parent context.Context) context.Context {
+	return context.WithValue(parent, TokenCtxKey, t)
+}
+
+// WithExpectedAudiences returns a copy of ctx, which overrides the accepted audiences for token validations with it, e.g. for routes of a multiplexed service.
+// A token validated with the returned context is accepted only if its 'aud' claim contains one of audiences, instead of the client id of the identity
+// or Options.AcceptedAudiences; this also applies if Options.SkipAudienceValidation is set. Use it with ValidateToken or before the AuthenticationHandler:
+//
+//	r = r.WithContext(auth.WithExpectedAudiences(r.Context(), "orders-api"))
+func WithExpectedAudiences(ctx context.Context, audiences ...string) context.Context {
+	return context.WithValue(ctx, expectedAudiencesCtxKey, audiences)
+}
+
+// expectedAudiencesFromContext returns the audiences of WithExpectedAudiences, or false if ctx does not override them
+func expectedAudiencesFromContext(ctx context.Context) ([]string, bool) {
+	audiences, ok := ctx.Value(expectedAudiencesCtxKey).([]string)
+	return audiences, ok
+}
+
 // ClientCertificateFromCtx retrieves the X.509 client certificate of a request which
 // have been injected before via the auth middleware
 func ClientCertificateFromCtx(r *http.Request) *Certificate {
@@ -54,39 +173,293 @@ func ClientCertificateFromCtx(r *http.Request) *Certificate {
 // Middleware is the main entrypoint to the authn client library, instantiate with NewMiddleware. It holds information about the oAuth config and configured options.
 // Use either the ready to use AuthenticationHandler as a middleware or implement your own middleware with the help of Authenticate.
 type Middleware struct {
-	identity    env.Identity
-	options     Options
-	oidcTenants *cache.Cache // contains *oidcclient.OIDCTenant
-	sf          singleflight.Group
-	tokenFlows  *tokenclient.TokenFlows
+	jwksRefreshes     uint64 // jwksRefreshes is accessed atomically, it is the first field to be 64-bit aligned on 32-bit platforms
+	identity          env.Identity
+	options           Options
+	oidcTenants       *lruCache // contains *oidcclient.OIDCTenant
+	failedDiscoveries *lruCache // contains the error of the failed discovery per issuer
+	tracer            trace.Tracer
+	stopCtx           context.Context // stopCtx is canceled by Close, it ends the background goroutines and aborts their requests
+	stop              context.CancelFunc
+	cacheJanitor      *cacheJanitor // deletes expired cache entries, nil if no cache needs it
+	wg                sync.WaitGroup
+	sf                singleflight.Group
+	generations       cacheGenerations
+	tokenCache        *tokenCache
+	introspections    *lruCache // contains the *introspectionResult per hash of the opaque token
+	dpopProofs        *lruCache // contains the hashes of the key thumbprint and jti of used DPoP proofs to reject replays
+	tokenFlows        *tokenclient.TokenFlows
 }
 
 // NewMiddleware instantiates a new Middleware with defaults for not provided Options.
+// It panics if the identity misses required fields or provides an invalid certificate/key, or if the options are invalid, see Options.Validate.
 func NewMiddleware(identity env.Identity, options Options) *Middleware {
 	m := new(Middleware)
 
-	if identity != nil {
-		m.identity = identity
-	} else {
-		log.Fatal("identity must not be nil, please refer to package env for default implementations")
+	if err := validateIdentity(identity); err != nil {
+		panic(err)
+	}
+	if err := options.Validate(); err != nil {
+		panic(err)
 	}
+	m.identity = identity
 	if options.ErrorHandler == nil {
 		options.ErrorHandler = DefaultErrorHandler
 	}
+	if options.Logger == nil {
+		options.Logger = noopLogger{}
+	}
+	if options.TracerProvider == nil {
+		options.TracerProvider = otel.GetTracerProvider()
+	}
+	if options.MetricsRecorder == nil {
+		options.MetricsRecorder = noopMetricsRecorder{}
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+	switch {
+	case options.ClockSkew == 0:
+		options.ClockSkew = defaultClockSkew
+	case options.ClockSkew < 0:
+		options.ClockSkew = 0
+	}
+	if options.TokenExtractor == nil {
+		options.TokenExtractor = AuthHeaderExtractor
+	}
+	if options.SecondaryTokenExtractor != nil && options.SecondaryTokenValidator == nil {
+		options.SecondaryTokenValidator = m.ValidateToken
+	}
+	if len(options.AllowedAlgorithms) == 0 {
+		options.AllowedAlgorithms = []jwa.SignatureAlgorithm{jwa.RS256, jwa.ES256, jwa.ES384, jwa.ES512, jwa.PS256, jwa.PS384, jwa.PS512}
+	}
+	if options.MinRSAKeyBits == 0 {
+		options.MinRSAKeyBits = defaultMinRSAKeyBits
+	}
 	if options.HTTPClient == nil {
 		tlsConfig, err := httpclient.DefaultTLSConfig(identity)
 		if err != nil {
-			log.Fatal("identity config provides invalid certificate/key: %w", err)
+			panic(fmt.Errorf("%w: identity config provides invalid certificate/key: %v", ErrInvalidConfig, err))
+		}
+		if options.TLSConfig != nil {
+			tlsConfig = mergeTLSConfig(options.TLSConfig, tlsConfig)
 		}
 		options.HTTPClient = httpclient.DefaultHTTPClient(tlsConfig)
 	}
 	m.options = options
+	m.tracer = options.TracerProvider.Tracer(tracerName)
+	if m.options.SymmetricKeyIssuer != "" && m.trustedDomain(m.options.SymmetricKeyIssuer) != "" {
+		// the shared secret must never verify tokens of an issuer which publishes JWKs, this prevents key confusion
+		panic(fmt.Errorf("%w: Options.SymmetricKeyIssuer '%s' must not match a domain of the identities", ErrInvalidConfig, m.options.SymmetricKeyIssuer))
+	}
 
-	m.oidcTenants = cache.New(cacheExpiration, cacheCleanupInterval)
+	if m.options.MaxTenants == 0 {
+		m.options.MaxTenants = defaultMaxTenants
+	}
+	m.oidcTenants = newLRUCache(m.options.MaxTenants)
+	if m.options.DiscoveryFailureCooldown == 0 {
+		m.options.DiscoveryFailureCooldown = defaultDiscoveryFailureCooldown
+	}
+	m.failedDiscoveries = newLRUCache(m.options.MaxTenants)
+	if m.options.DiscoveryRetries == 0 {
+		m.options.DiscoveryRetries = defaultDiscoveryRetries
+	}
+	if m.options.DiscoveryRetryBaseDelay == 0 {
+		m.options.DiscoveryRetryBaseDelay = defaultDiscoveryRetryBaseDelay
+	}
+	if m.options.JWKsFetchBurst == 0 {
+		m.options.JWKsFetchBurst = defaultJWKsFetchBurst
+	}
+	if m.options.JWKsFetchInterval == 0 {
+		m.options.JWKsFetchInterval = defaultJWKsFetchInterval
+	}
+	if options.EnableTokenCache {
+		if m.options.TokenCacheMaxSize == 0 {
+			m.options.TokenCacheMaxSize = defaultTokenCacheMaxSize
+		}
+		m.tokenCache = newTokenCache(m.options.TokenCacheMaxSize)
+	}
+	if options.EnableDPoP {
+		if m.options.DPoPProofWindow == 0 {
+			m.options.DPoPProofWindow = defaultDPoPProofWindow
+		}
+		if m.options.DPoPReplayCacheMaxSize == 0 {
+			m.options.DPoPReplayCacheMaxSize = defaultDPoPReplayCacheMaxSize
+		}
+		m.dpopProofs = newLRUCache(m.options.DPoPReplayCacheMaxSize)
+	}
+	if options.EnableIntrospection {
+		if m.options.TokenCacheMaxSize == 0 {
+			m.options.TokenCacheMaxSize = defaultTokenCacheMaxSize
+		}
+		if m.options.IntrospectionCacheTTL == 0 {
+			m.options.IntrospectionCacheTTL = defaultIntrospectionCacheTTL
+		}
+		if m.options.InactiveTokenCacheTTL == 0 {
+			m.options.InactiveTokenCacheTTL = defaultInactiveTokenCacheTTL
+		}
+		m.introspections = newLRUCache(m.options.TokenCacheMaxSize)
+	}
+
+	m.stopCtx, m.stop = context.WithCancel(context.Background())
+	// the tenant caches are bounded by MaxTenants, only the caches of tokens and DPoP proofs grow with the traffic and need a cleanup
+	if m.tokenCache != nil || m.introspections != nil || m.dpopProofs != nil {
+		caches := []*lruCache{m.oidcTenants, m.failedDiscoveries}
+		for _, cache := range []*lruCache{m.introspections, m.dpopProofs} {
+			if cache != nil {
+				caches = append(caches, cache)
+			}
+		}
+		if m.tokenCache != nil {
+			caches = append(caches, m.tokenCache.tokens)
+		}
+		m.cacheJanitor = startCacheJanitor(cacheCleanupInterval, m.options.Clock, caches...)
+		runtime.SetFinalizer(m, func(m *Middleware) { m.cacheJanitor.stop() })
+	}
+	if options.EnableBackgroundKeyRefresh {
+		if m.options.BackgroundKeyRefreshLeadTime <= 0 {
+			m.options.BackgroundKeyRefreshLeadTime = defaultKeyRefreshLeadTime
+		}
+		m.wg.Add(1)
+		go m.refreshKeysInBackground()
+	}
 
 	return m
 }
 
+// Validate returns an error if the options are inconsistent. Not provided options are valid, as NewMiddleware applies defaults for them.
+func (o Options) Validate() error {
+	if o.HTTPClient != nil && o.TLSConfig != nil {
+		return fmt.Errorf("%w: Options.TLSConfig is only applied to the default client, configure the transport of Options.HTTPClient instead", ErrInvalidConfig)
+	}
+	if o.BackgroundKeyRefreshLeadTime < 0 {
+		return fmt.Errorf("%w: Options.BackgroundKeyRefreshLeadTime must not be negative", ErrInvalidConfig)
+	}
+	if o.TokenCacheMaxSize < 0 {
+		return fmt.Errorf("%w: Options.TokenCacheMaxSize must not be negative", ErrInvalidConfig)
+	}
+	if o.MaxTenants < 0 {
+		return fmt.Errorf("%w: Options.MaxTenants must not be negative", ErrInvalidConfig)
+	}
+	if o.DiscoveryRetryBaseDelay < 0 {
+		return fmt.Errorf("%w: Options.DiscoveryRetryBaseDelay must not be negative", ErrInvalidConfig)
+	}
+	if o.DPoPProofWindow < 0 {
+		return fmt.Errorf("%w: Options.DPoPProofWindow must not be negative", ErrInvalidConfig)
+	}
+	if o.DPoPReplayCacheMaxSize < 0 {
+		return fmt.Errorf("%w: Options.DPoPReplayCacheMaxSize must not be negative", ErrInvalidConfig)
+	}
+	if o.DiscoveryMaxRetryAfter < 0 {
+		return fmt.Errorf("%w: Options.DiscoveryMaxRetryAfter must not be negative", ErrInvalidConfig)
+	}
+	if o.DiscoveryFailureCooldown < 0 {
+		return fmt.Errorf("%w: Options.DiscoveryFailureCooldown must not be negative", ErrInvalidConfig)
+	}
+	if o.MinRSAKeyBits < 0 {
+		return fmt.Errorf("%w: Options.MinRSAKeyBits must not be negative", ErrInvalidConfig)
+	}
+	if o.MaxAuthAge < 0 {
+		return fmt.Errorf("%w: Options.MaxAuthAge must not be negative", ErrInvalidConfig)
+	}
+	if o.JWKsFetchBurst < 0 {
+		return fmt.Errorf("%w: Options.JWKsFetchBurst must not be negative", ErrInvalidConfig)
+	}
+	if o.JWKsFetchInterval < 0 {
+		return fmt.Errorf("%w: Options.JWKsFetchInterval must not be negative", ErrInvalidConfig)
+	}
+	if o.MinJWKsCacheTTL < 0 || o.MaxJWKsCacheTTL < 0 {
+		return fmt.Errorf("%w: Options.MinJWKsCacheTTL and Options.MaxJWKsCacheTTL must not be negative", ErrInvalidConfig)
+	}
+	if o.MaxJWKsCacheTTL > 0 && o.MinJWKsCacheTTL > o.MaxJWKsCacheTTL {
+		return fmt.Errorf("%w: Options.MinJWKsCacheTTL must not exceed Options.MaxJWKsCacheTTL", ErrInvalidConfig)
+	}
+	if err := o.validateSymmetricKey(); err != nil {
+		return err
+	}
+	if o.IntrospectionCacheTTL < 0 {
+		return fmt.Errorf("%w: Options.IntrospectionCacheTTL must not be negative", ErrInvalidConfig)
+	}
+	if o.InactiveTokenCacheTTL < 0 {
+		return fmt.Errorf("%w: Options.InactiveTokenCacheTTL must not be negative", ErrInvalidConfig)
+	}
+	if o.JWKsURL != "" {
+		if u, err := url.Parse(o.JWKsURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%w: Options.JWKsURL '%s' must be an absolute URL", ErrInvalidConfig, o.JWKsURL)
+		}
+	}
+	if o.DiscoveryPath != "" {
+		if u, err := url.Parse(o.DiscoveryPath); err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(o.DiscoveryPath, "/") || strings.HasPrefix(o.DiscoveryPath, "//") || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("%w: Options.DiscoveryPath '%s' must be a path relative to the issuer starting with '/'", ErrInvalidConfig, o.DiscoveryPath)
+		}
+	}
+	if o.IntrospectionURL != "" {
+		if u, err := url.Parse(o.IntrospectionURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%w: Options.IntrospectionURL '%s' must be an absolute URL", ErrInvalidConfig, o.IntrospectionURL)
+		}
+	}
+	for _, identity := range o.AdditionalIdentities {
+		if err := validateIdentity(identity); err != nil {
+			return fmt.Errorf("Options.AdditionalIdentities: %w", err)
+		}
+	}
+	for _, path := range o.SkipPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("%w: Options.SkipPaths entry '%s' must start with '/'", ErrInvalidConfig, path)
+		}
+	}
+	return nil
+}
+
+// validateSymmetricKey ensures that HMAC signed tokens are only accepted if explicitly allowed and with a sufficiently long secret of a dedicated issuer
+func (o Options) validateSymmetricKey() error {
+	allowsSymmetricAlg := false
+	for _, alg := range o.AllowedAlgorithms {
+		if isSymmetricAlgorithm(alg) {
+			allowsSymmetricAlg = true
+		}
+	}
+	switch {
+	case len(o.SymmetricKey) == 0 && o.SymmetricKeyIssuer == "" && !allowsSymmetricAlg:
+		return nil
+	case len(o.SymmetricKey) == 0:
+		return fmt.Errorf("%w: Options.SymmetricKeyIssuer and HMAC algorithms in Options.AllowedAlgorithms require Options.SymmetricKey", ErrInvalidConfig)
+	case len(o.SymmetricKey) < minSymmetricKeyBytes:
+		return fmt.Errorf("%w: Options.SymmetricKey must have at least %d bytes", ErrInvalidConfig, minSymmetricKeyBytes)
+	case !allowsSymmetricAlg:
+		return fmt.Errorf("%w: Options.SymmetricKey requires a HMAC algorithm like HS256 in Options.AllowedAlgorithms", ErrInvalidConfig)
+	case o.SymmetricKeyIssuer == "":
+		return fmt.Errorf("%w: Options.SymmetricKey requires Options.SymmetricKeyIssuer", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// mergeTLSConfig returns a copy of custom, which presents the client certificate of the identity if custom provides none.
+// The copy ensures the library never modifies a tls.Config which is shared with other clients of the caller.
+func mergeTLSConfig(custom *tls.Config, identityTLSConfig *tls.Config) *tls.Config {
+	merged := custom.Clone()
+	if len(merged.Certificates) == 0 && identityTLSConfig != nil {
+		merged.Certificates = identityTLSConfig.Certificates
+	}
+	if merged.MinVersion == 0 {
+		merged.MinVersion = tls.VersionTLS12
+	}
+	return merged
+}
+
+// validateIdentity returns an error naming the first missing field of the identity which is required for token validation
+func validateIdentity(identity env.Identity) error {
+	switch {
+	case identity == nil || reflect.ValueOf(identity).Kind() == reflect.Ptr && reflect.ValueOf(identity).IsNil():
+		return fmt.Errorf("%w: identity must not be nil, please refer to package env for default implementations", ErrInvalidConfig)
+	case identity.GetClientID() == "":
+		return fmt.Errorf("%w: identity provides no client id", ErrInvalidConfig)
+	case len(identity.GetDomains()) == 0:
+		return fmt.Errorf("%w: identity provides no domains", ErrInvalidConfig)
+	}
+	return nil
+}
+
 // GetTokenFlows creates or returns TokenFlows, otherwise error is returned
 func (m *Middleware) GetTokenFlows() (*tokenclient.TokenFlows, error) {
 	if m.tokenFlows == nil {
@@ -99,6 +472,67 @@ func (m *Middleware) GetTokenFlows() (*tokenclient.TokenFlows, error) {
 	return m.tokenFlows, nil
 }
 
+// ValidateToken validates the encoded jwt independent of its transport, e.g. for gRPC or messaging scenarios.
+// It returns the Token if validation was successful, otherwise the error is returned, see ErrTokenExpired and related errors.
+// A valid token which lacks any of Options.RequiredScopes is rejected with ErrInsufficientScope.
+func (m *Middleware) ValidateToken(ctx context.Context, rawToken string) (Token, error) {
+	token, err := m.validateAndObserve(ctx, rawToken)
+	if err != nil {
+		return Token{}, err
+	}
+	if err = m.verifyRequiredScopes(token); err != nil {
+		m.options.Logger.Debug("token lacks required scope", "error", err)
+		return Token{}, err
+	}
+	return token, nil
+}
+
+// ValidateIDToken validates the ID token like ValidateToken and additionally requires its 'nonce' claim to be expectedNonce,
+// i.e. the nonce which was sent in the authentication request of an implicit or hybrid flow, to prevent replay attacks.
+// A missing or different nonce is rejected with ErrNonceMismatch. An empty expectedNonce is rejected as well, e.g. if the nonce got lost with the session,
+// as the replay would go unnoticed otherwise. Options.RequiredScopes are not checked, as ID tokens carry no scopes.
+func (m *Middleware) ValidateIDToken(ctx context.Context, rawToken string, expectedNonce string) (Token, error) {
+	if expectedNonce == "" {
+		m.options.Logger.Debug("token validation failed", "error", ErrNonceMismatch)
+		return Token{}, fmt.Errorf("%w: no nonce expected", ErrNonceMismatch)
+	}
+	token, err := m.validateAndObserve(ctx, rawToken)
+	if err != nil {
+		return Token{}, err
+	}
+	if nonce := token.Nonce(); subtle.ConstantTimeCompare([]byte(nonce), []byte(expectedNonce)) != 1 {
+		m.options.Logger.Debug("token validation failed", "error", ErrNonceMismatch)
+		if nonce == "" {
+			return Token{}, fmt.Errorf("%w: token has no nonce", ErrNonceMismatch)
+		}
+		return Token{}, ErrNonceMismatch
+	}
+	return token, nil
+}
+
+// validateAndObserve validates the encoded jwt with parseAndValidateJWT and records the outcome with the MetricsRecorder and Logger
+func (m *Middleware) validateAndObserve(ctx context.Context, rawToken string) (Token, error) {
+	start := time.Now()
+	token, err := m.parseAndValidateJWT(ctx, rawToken)
+	m.options.MetricsRecorder.ObserveValidationDuration(time.Since(start))
+	m.options.MetricsRecorder.IncValidation(validationOutcome(err))
+	if err != nil {
+		m.options.Logger.Debug("token validation failed", "error", err)
+		return Token{}, err
+	}
+	return token, nil
+}
+
+// verifyRequiredScopes returns ErrInsufficientScope if the token lacks any of Options.RequiredScopes
+func (m *Middleware) verifyRequiredScopes(token Token) error {
+	for _, scope := range m.options.RequiredScopes {
+		if !token.HasScope(scope) {
+			return fmt.Errorf("%w: %s", ErrInsufficientScope, scope)
+		}
+	}
+	return nil
+}
+
 // Authenticate authenticates a request and returns the Token if validation was successful, otherwise error is returned
 func (m *Middleware) Authenticate(r *http.Request) (Token, error) {
 	token, _, err := m.AuthenticateWithProofOfPossession(r)
@@ -109,33 +543,65 @@ func (m *Middleware) Authenticate(r *http.Request) (Token, error) {
 // AuthenticateWithProofOfPossession authenticates a request and returns the Token and the client certificate if validation was successful,
 // otherwise error is returned
 func (m *Middleware) AuthenticateWithProofOfPossession(r *http.Request) (Token, *Certificate, error) {
-	// get Token from Header
-	rawToken, err := extractRawToken(r)
-	if err != nil {
-		return Token{}, nil, err
+	// get Token from request, the DPoP scheme is only accepted if enabled
+	rawToken, dpopSchemeUsed := "", false
+	if m.options.EnableDPoP {
+		rawToken, dpopSchemeUsed = dpopHeaderExtractor(r)
+	}
+	if !dpopSchemeUsed {
+		var err error
+		if rawToken, err = m.options.TokenExtractor(r); err != nil {
+			return Token{}, nil, err
+		}
 	}
 
-	token, err := m.parseAndValidateJWT(rawToken)
+	token, err := m.ValidateToken(r.Context(), rawToken)
 	if err != nil {
 		return Token{}, nil, err
 	}
 
-	const forwardedClientCertHeader = "x-forwarded-client-cert"
-	var cert *Certificate
-	cert, err = newCertificate(r.Header.Get(forwardedClientCertHeader))
+	cert, err := m.clientCertificate(r)
 	if err != nil {
 		return Token{}, nil, err
 	}
-	if "1" == "" && cert != nil { // TODO integrate proof of possession into middleware
+	if m.options.EnableProofOfPossession {
 		err = validateCertificate(cert, token)
 		if err != nil {
 			return Token{}, nil, err
 		}
 	}
+	if m.options.EnableDPoP {
+		if err := m.validateDPoP(r, token, dpopSchemeUsed); err != nil {
+			return Token{}, nil, err
+		}
+	}
+	if m.options.SecondaryTokenExtractor != nil {
+		secondary, err := m.authenticateSecondary(r)
+		if err != nil {
+			return Token{}, nil, err
+		}
+		token.secondary = &secondary
+	}
 
 	return token, cert, nil
 }
 
+// clientCertificate returns the client certificate of the TLS connection, or the one forwarded by a proxy in the 'x-forwarded-client-cert' header if Options.TrustForwardedClientCert is set.
+// The header is never read for TLS connections, a client could present any certificate with it. Returns nil, if the request provides no client certificate.
+func (m *Middleware) clientCertificate(r *http.Request) (*Certificate, error) {
+	if r.TLS != nil {
+		if len(r.TLS.PeerCertificates) > 0 {
+			return &Certificate{x509Cert: r.TLS.PeerCertificates[0]}, nil
+		}
+		return nil, nil
+	}
+	if !m.options.TrustForwardedClientCert {
+		return nil, nil
+	}
+	const forwardedClientCertHeader = "x-forwarded-client-cert"
+	return newCertificate(r.Header.Get(forwardedClientCertHeader))
+}
+
 // AuthenticationHandler authenticates a request and injects the claims into
 // the request context. If the authentication (see Authenticate) does not succeed,
 // the specified error handler (see Options.ErrorHandler) will be called and
@@ -144,14 +610,23 @@ func (m *Middleware) AuthenticateWithProofOfPossession(r *http.Request) (Token,
 // as well as the client certificate (if given).
 func (m *Middleware) AuthenticationHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.isSkipped(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		token, cert, err := m.AuthenticateWithProofOfPossession(r)
 
 		if err != nil {
+			if m.options.AllowAnonymous && errors.Is(err, ErrNoToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
 			m.options.ErrorHandler(w, r, err)
 			return
 		}
 
-		ctx := context.WithValue(context.WithValue(r.Context(), TokenCtxKey, token), ClientCertificateCtxKey, cert)
+		ctx := context.WithValue(token.NewContext(r.Context()), ClientCertificateCtxKey, cert)
 		*r = *r.WithContext(ctx)
 
 		// Continue serving http if jwt was valid
@@ -159,12 +634,137 @@ func (m *Middleware) AuthenticationHandler(next http.Handler) http.Handler {
 	})
 }
 
-// ClearCache clears the entire storage of cached oidc tenants including their JWKs
+// isSkipped returns true if the request path matches one of Options.SkipPaths
+func (m *Middleware) isSkipped(r *http.Request) bool {
+	for _, skipPath := range m.options.SkipPaths {
+		if prefix := strings.TrimSuffix(skipPath, "*"); prefix != skipPath {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		} else if r.URL.Path == skipPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Close releases the resources of the Middleware: it stops all background goroutines, e.g. the background key refresh
+// (see Options.EnableBackgroundKeyRefresh), and closes idle connections of the HTTP client.
+// Without Close, the cleanup of the token caches is stopped once the Middleware is garbage collected, the background key refresh is not.
+// Close should be called during a graceful server shutdown. It is safe to call Close multiple times.
+func (m *Middleware) Close() error {
+	m.stop()
+	if m.cacheJanitor != nil {
+		m.cacheJanitor.stop()
+		<-m.cacheJanitor.done
+	}
+	m.wg.Wait()
+	m.options.HTTPClient.CloseIdleConnections()
+	return nil
+}
+
+// refreshKeysInBackground refreshes expiring keys periodically until the Middleware is closed
+func (m *Middleware) refreshKeysInBackground() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.options.BackgroundKeyRefreshLeadTime / 2) //nolint:gomnd // check twice within lead time
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopCtx.Done():
+			return
+		case <-ticker.C:
+			m.refreshExpiringKeys()
+		}
+	}
+}
+
+// refreshExpiringKeys refreshes the keys of all cached oidc tenants which expire within the lead time.
+// The refresh is aborted once the Middleware is closed, so that Close does not wait for slow JWKs endpoints.
+func (m *Middleware) refreshExpiringKeys() {
+	for _, item := range m.oidcTenants.values() {
+		if m.stopCtx.Err() != nil {
+			return
+		}
+		oidcTenant := item.(*oidcclient.OIDCTenant)
+		ctx, cancel := context.WithTimeout(m.stopCtx, m.options.BackgroundKeyRefreshLeadTime)
+		err := oidcTenant.RefreshExpiringJWKs(ctx, m.options.BackgroundKeyRefreshLeadTime)
+		cancel()
+		if err != nil && m.stopCtx.Err() == nil {
+			m.options.Logger.Error("background jwks refresh failed", "issuer", oidcTenant.ProviderJSON.Issuer, "error", err)
+		}
+	}
+}
+
+// PreloadIssuer performs the OIDC discovery for the trusted issuer and caches its JWKs, e.g. at startup to avoid the latency on the first request.
+// The JWKs are fetched for the zone of the identity. It returns ErrUntrustedIssuer if the issuer does not match the domains of the identity.
+func (m *Middleware) PreloadIssuer(ctx context.Context, issuer string) error {
+	oidcTenant, err := m.getOIDCTenant(ctx, issuer, "")
+	if err != nil {
+		return err
+	}
+	var zoneID string
+	if zoneUUID := m.identity.GetZoneUUID(); zoneUUID != uuid.Nil {
+		zoneID = zoneUUID.String()
+	}
+	if _, err := oidcTenant.GetJWKs(ctx, zoneID); err != nil {
+		return fmt.Errorf("unable to preload jwks of issuer %s: %w", issuer, err)
+	}
+	return nil
+}
+
+// CheckConnectivity verifies that the IAS tenant of the identity is reachable, e.g. for a readiness probe.
+// It performs the OIDC discovery against the URL of the identity, unless its result is already cached, and requires no token.
+func (m *Middleware) CheckConnectivity(ctx context.Context) error {
+	if _, err := m.getOIDCTenant(ctx, m.identity.GetURL(), ""); err != nil {
+		return fmt.Errorf("unable to reach IAS tenant %s: %w", m.identity.GetURL(), err)
+	}
+	return nil
+}
+
+// DiscoveryDocument returns the OIDC discovery document of the trusted issuer, e.g. Token.Issuer(), to use its endpoints like ProviderJSON.EndSessionURL for a logout.
+// The discovery is performed unless its result is already cached. Issuers which match no domain of the identities are rejected with ErrUntrustedIssuer.
+// The returned document is a copy, but its slices are shared with the cache and must not be modified.
+func (m *Middleware) DiscoveryDocument(issuer string) (*oidcclient.ProviderJSON, error) {
+	oidcTenant, err := m.getOIDCTenant(context.Background(), issuer, "")
+	if err != nil {
+		return nil, err
+	}
+	providerJSON := oidcTenant.ProviderJSON
+	return &providerJSON, nil
+}
+
+// InvalidateCache clears the cached oidc tenants including their JWKs and failed discoveries, e.g. after a coordinated key rotation.
+// The next token of each issuer performs a fresh discovery. Discoveries which are in flight meanwhile are not cached and not joined by later requests.
+// Cached tokens are verified against the fresh JWKs on their next use.
+func (m *Middleware) InvalidateCache() {
+	m.generations.invalidateAll()
+	m.oidcTenants.flush()
+	m.failedDiscoveries.flush()
+}
+
+// InvalidateIssuer clears the cached oidc tenant including the JWKs and the failed discovery of the issuer only, e.g. after a key rotation of a single tenant.
+// The next token of the issuer performs a fresh discovery, the other issuers remain cached. Discoveries of the issuer which are in flight meanwhile are not cached.
+func (m *Middleware) InvalidateIssuer(issuer string) {
+	m.generations.invalidate(issuer)
+	m.oidcTenants.delete(issuer)
+	m.failedDiscoveries.delete(issuer)
+}
+
+// ClearCache clears the entire storage of cached oidc tenants including their JWKs, see InvalidateCache,
+// as well as the validated tokens if Options.EnableTokenCache is set and the introspection results if Options.EnableIntrospection is set
 func (m *Middleware) ClearCache() {
-	m.oidcTenants.Flush()
+	m.InvalidateCache()
+	if m.tokenCache != nil {
+		m.tokenCache.flush()
+	}
+	if m.introspections != nil {
+		m.introspections.flush()
+	}
 }
 
-// DefaultErrorHandler responds with the error and HTTP status 401
+// DefaultErrorHandler responds with the HTTP status of ErrorStatusCode, i.e. 401 or 403, and the error code and description as JSON body, see ErrorResponse.
+// It sets the WWW-Authenticate header as specified by RFC 6750, see BearerChallenge. Use NewPlainTextErrorHandler for a plain text body instead
 func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
-	http.Error(w, err.Error(), http.StatusUnauthorized)
+	NewErrorHandler(ErrorStatusCode)(w, r, err)
 }
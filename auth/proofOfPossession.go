@@ -9,10 +9,14 @@ package auth
 // Proof of possession uses certificates as proof token and therefore, x.509 based mTLS communication is demanded.
 import (
 	"errors"
-	"fmt"
 )
 
-var ErrNoClientCert = errors.New("there is no x509 client certificate provided")
+// Errors returned by the proof of possession check, see Options.EnableProofOfPossession
+var (
+	ErrNoClientCert         = errors.New("there is no x509 client certificate provided")
+	ErrMissingCnfThumbprint = errors.New("token provides no cnf member for thumbprint confirmation")
+	ErrThumbprintMismatch   = errors.New("token thumbprint confirmation failed")
+)
 
 // validateCertificate runs all proof of possession checks.
 // This ensures that the token was issued for the sender.
@@ -30,13 +34,16 @@ func validateX5tThumbprint(clientCertificate *Certificate, token Token) error {
 		return ErrNoClientCert
 	}
 
-	cnfThumbprint := token.getCnfClaimMember(claimCnfMemberX5t)
+	cnfThumbprint, err := token.getCnfClaimMember(claimCnfMemberX5t)
+	if err != nil {
+		return err
+	}
 	if cnfThumbprint == "" {
-		return fmt.Errorf("token provides no cnf member for thumbprint confirmation")
+		return ErrMissingCnfThumbprint
 	}
 
 	if cnfThumbprint != clientCertificate.GetThumbprint() {
-		return fmt.Errorf("token thumbprint confirmation failed")
+		return ErrThumbprintMismatch
 	}
 	return nil
 }
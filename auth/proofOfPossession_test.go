@@ -4,10 +4,16 @@
 package auth
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/mocks"
 )
 
 var derCertGenerated = generateDERCert()
@@ -92,3 +98,128 @@ func TestProofOfPossession_validateX5tThumbprint(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthenticateWithProofOfPossession(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	require.NoError(t, err, "error creating test setup")
+	defer oidcMockServer.Server.Close()
+	clientCert, err := newCertificate(derCertGenerated)
+	require.NoError(t, err, "Failed to parse cert header: %v", err)
+	otherCert, err := newCertificate(derCertFromFile)
+	require.NoError(t, err, "Failed to parse cert header: %v", err)
+
+	tests := []struct {
+		name                    string
+		enableProofOfPossession bool
+		thumbprint              string
+		peerCertificate         *x509.Certificate
+		tlsConnection           bool
+		forwardedCert           string
+		trustForwardedCert      bool
+		wantErr                 error
+	}{
+		{
+			name:                    "matching thumbprint of tls client certificate",
+			enableProofOfPossession: true,
+			thumbprint:              clientCert.GetThumbprint(),
+			peerCertificate:         clientCert.x509Cert,
+		}, {
+			name:                    "matching thumbprint of forwarded client certificate",
+			enableProofOfPossession: true,
+			thumbprint:              clientCert.GetThumbprint(),
+			forwardedCert:           derCertGenerated,
+			trustForwardedCert:      true,
+		}, {
+			name:                    "forwarded client certificate is not trusted by default",
+			enableProofOfPossession: true,
+			thumbprint:              clientCert.GetThumbprint(),
+			forwardedCert:           derCertGenerated,
+			wantErr:                 ErrNoClientCert,
+		}, {
+			name:                    "forged forwarded client certificate on tls connection",
+			enableProofOfPossession: true,
+			thumbprint:              clientCert.GetThumbprint(),
+			tlsConnection:           true,
+			forwardedCert:           derCertGenerated,
+			trustForwardedCert:      true,
+			wantErr:                 ErrNoClientCert,
+		}, {
+			name:                    "mismatching thumbprint",
+			enableProofOfPossession: true,
+			thumbprint:              otherCert.GetThumbprint(),
+			peerCertificate:         clientCert.x509Cert,
+			wantErr:                 ErrThumbprintMismatch,
+		}, {
+			name:                    "no cnf thumbprint",
+			enableProofOfPossession: true,
+			peerCertificate:         clientCert.x509Cert,
+			wantErr:                 ErrMissingCnfThumbprint,
+		}, {
+			name:                    "no client certificate",
+			enableProofOfPossession: true,
+			thumbprint:              clientCert.GetThumbprint(),
+			wantErr:                 ErrNoClientCert,
+		}, {
+			name:            "mismatching thumbprint is not checked by default",
+			thumbprint:      otherCert.GetThumbprint(),
+			peerCertificate: clientCert.x509Cert,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient:               oidcMockServer.Server.Client(),
+				EnableProofOfPossession:  tt.enableProofOfPossession,
+				TrustForwardedClientCert: tt.trustForwardedCert,
+			})
+			additionalClaims := map[string]interface{}{}
+			if tt.thumbprint != "" {
+				additionalClaims[claimCnf] = map[string]interface{}{claimCnfMemberX5t: tt.thumbprint}
+			}
+			rawToken, err := oidcMockServer.SignTokenWithAdditionalClaims(oidcMockServer.DefaultClaims(), additionalClaims, oidcMockServer.DefaultHeaders())
+			require.NoError(t, err, "unable to sign provided test token")
+
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			req.Header.Set("Authorization", "bearer "+rawToken)
+			if tt.peerCertificate != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.peerCertificate}}
+			} else if tt.tlsConnection {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.forwardedCert != "" {
+				req.Header.Set("x-forwarded-client-cert", tt.forwardedCert)
+			}
+
+			_, cert, err := m.AuthenticateWithProofOfPossession(req)
+			assert.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr == nil {
+				assert.Equal(t, clientCert.GetThumbprint(), cert.GetThumbprint())
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithProofOfPossession_invalidCnf(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	m := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client(), EnableProofOfPossession: true})
+	defer m.Close()
+	clientCert, err := newCertificate(derCertGenerated)
+	require.NoError(t, err, "Failed to parse cert header: %v", err)
+
+	for name, cnf := range map[string]interface{}{
+		"non-string x5t#S256": map[string]interface{}{claimCnfMemberX5t: 1},
+		"non-object cnf":      clientCert.GetThumbprint(),
+	} {
+		cnf := cnf
+		t.Run(name, func(t *testing.T) {
+			rawToken := oidcMockServer.MustSignToken(t, map[string]interface{}{claimCnf: cnf})
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			req.Header.Set("Authorization", "bearer "+rawToken)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert.x509Cert}}
+
+			_, _, err := m.AuthenticateWithProofOfPossession(req)
+			assert.ErrorIs(t, err, ErrInvalidCnfClaim)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrMissingSecondaryToken is returned if Options.SecondaryTokenExtractor is set, but the request provides no secondary token.
+// Unlike ErrNoToken, it is never served anonymously by Options.AllowAnonymous, as the request authenticated with its primary token.
+var ErrMissingSecondaryToken = errors.New("no secondary token provided in the request")
+
+// TokenValidator validates an encoded token, e.g. Middleware.ValidateToken of a Middleware configured for another identity, see Options.SecondaryTokenValidator
+type TokenValidator func(ctx context.Context, rawToken string) (Token, error)
+
+// authenticateSecondary extracts and validates the secondary token of the request, see Options.SecondaryTokenExtractor.
+// The request is rejected if the secondary token is missing or invalid, even if the primary token is valid.
+func (m *Middleware) authenticateSecondary(r *http.Request) (Token, error) {
+	rawToken, err := m.options.SecondaryTokenExtractor(r)
+	if err != nil {
+		// the cause must not wrap ErrNoToken, the primary token has been provided
+		return Token{}, fmt.Errorf("%w: %v", ErrMissingSecondaryToken, err)
+	}
+	token, err := m.options.SecondaryTokenValidator(r.Context(), rawToken)
+	if err != nil {
+		return Token{}, fmt.Errorf("secondary token: %w", err)
+	}
+	return token, nil
+}
+
+// SecondaryToken returns the secondary token which was validated together with t, see Options.SecondaryTokenExtractor. Returns false, if there is none.
+func (t Token) SecondaryToken() (Token, bool) {
+	if t.secondary == nil {
+		return Token{}, false
+	}
+	return *t.secondary, true
+}
+
+// SecondaryTokenFromContext retrieves the secondary token of the validated Token which has been injected into the context, see Token.SecondaryToken.
+// Returns false, if the context holds no Token or the Token has no secondary token.
+func SecondaryTokenFromContext(ctx context.Context) (Token, bool) {
+	token, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return Token{}, false
+	}
+	return token.SecondaryToken()
+}
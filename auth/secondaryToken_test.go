@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+func TestAuthenticate_secondaryToken(t *testing.T) {
+	primaryServer := mocks.NewTestOIDCMockServer(t)
+	secondaryServer := mocks.NewTestOIDCMockServer(t)
+	secondaryServer.Config.ClientID = "secondary-clientid"
+	secondaryMiddleware := NewMiddleware(secondaryServer.Config, Options{HTTPClient: secondaryServer.Server.Client()})
+	defer secondaryMiddleware.Close()
+	middleware := NewMiddleware(primaryServer.Config, Options{
+		HTTPClient:              primaryServer.Server.Client(),
+		SecondaryTokenExtractor: HeaderExtractor("X-Secondary-Token"),
+		SecondaryTokenValidator: secondaryMiddleware.ValidateToken,
+	})
+	defer middleware.Close()
+
+	primaryToken := primaryServer.MustSignToken(t, map[string]interface{}{"email": "primary@example.org"})
+	secondaryToken := secondaryServer.MustSignToken(t, map[string]interface{}{"email": "secondary@example.org"})
+
+	tests := []struct {
+		name      string
+		primary   string
+		secondary string
+		wantErr   error
+	}{
+		{name: "both valid", primary: primaryToken, secondary: secondaryToken},
+		{name: "invalid secondary token", primary: primaryToken, secondary: primaryToken, wantErr: ErrUntrustedIssuer},
+		{name: "invalid primary token", primary: secondaryToken, secondary: secondaryToken, wantErr: ErrUntrustedIssuer},
+		{name: "missing secondary token", primary: primaryToken, wantErr: ErrMissingSecondaryToken},
+		{name: "missing primary token", secondary: secondaryToken, wantErr: ErrNoToken},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			if tt.primary != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.primary)
+			}
+			if tt.secondary != "" {
+				req.Header.Set("X-Secondary-Token", tt.secondary)
+			}
+			token, err := middleware.Authenticate(req)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "primary@example.org", token.Email())
+			secondary, ok := token.SecondaryToken()
+			require.True(t, ok)
+			assert.Equal(t, "secondary@example.org", secondary.Email())
+		})
+	}
+}
+
+func TestAuthenticationHandler_secondaryToken(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:              oidcMockServer.Server.Client(),
+		SecondaryTokenExtractor: HeaderExtractor("X-Secondary-Token"),
+		AllowAnonymous:          true,
+	})
+	defer middleware.Close()
+	var secondary Token
+	handler := middleware.AuthenticationHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondary, _ = SecondaryTokenFromContext(r.Context())
+	}))
+	rawToken := oidcMockServer.MustSignToken(t, nil)
+	secondaryToken := oidcMockServer.MustSignToken(t, map[string]interface{}{"email": "secondary@example.org"})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+rawToken)
+	req.Header.Set("X-Secondary-Token", secondaryToken)
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "secondary@example.org", secondary.Email(), "the secondary token is validated by the Middleware itself by default")
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+rawToken)
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "a missing secondary token must not be served anonymously")
+
+	_, err := middleware.Authenticate(req)
+	assert.False(t, errors.Is(err, ErrNoToken))
+}
@@ -6,10 +6,15 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jws"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/lestrrat-go/jwx/jwt/openid"
 )
@@ -21,25 +26,74 @@ const (
 	claimFamilyName      = "family_name"
 	claimEmail           = "email"
 	claimSapGlobalUserID = "user_uuid"
-	claimSapGlobalZoneID = "zone_uuid" // tenant GUID
+	claimSapGlobalZoneID = "zone_uuid" // tenant GUID, superseded by app_tid
+	claimAppTID          = "app_tid"
 	claimIasIssuer       = "ias_iss"
+	claimScope           = "scope"
+	claimScopes          = "scopes"
+	claimAzp             = "azp"
+	claimAuthTime        = "auth_time"
+	claimAmr             = "amr"
+	claimNonce           = "nonce"
 )
 
 type Token struct {
-	encodedToken string
-	jwtToken     jwt.Token
+	encodedToken   string
+	jwtToken       jwt.Token
+	alg            jwa.SignatureAlgorithm // 'alg' header of the signature
+	verifiedKeyID  string
+	verifiedIssuer string
+	verifiedDomain string
+	clock          func() time.Time // clock of the Middleware which validated the token, nil for unverified tokens
+	clockSkew      time.Duration    // Options.ClockSkew of the Middleware which validated the token, only set together with clock
+	xsAppName      string           // Options.XSAppName of the Middleware which validated the token
+	secondary      *Token           // secondary token validated in the same request, see Options.SecondaryTokenExtractor
 }
 
 // NewToken creates a Token from an encoded jwt. !!! WARNING !!! No validation done when creating a Token this way. Use only in tests!
+// See also ParseUnverified
 func NewToken(encodedToken string) (Token, error) {
-	decodedToken, err := jwt.ParseString(encodedToken, jwt.WithToken(openid.New()))
+	return ParseUnverified(encodedToken)
+}
+
+// ParseUnverified decodes the claims of an encoded jwt, e.g. to inspect token contents in tests or tooling.
+// !!! WARNING !!! Neither the signature nor any claim is validated, so the Token must NOT be used for trust decisions.
+// Use Middleware.Authenticate or Middleware.ValidateToken to obtain a validated Token instead.
+func ParseUnverified(encodedToken string) (Token, error) {
+	msg, err := parseJWS(encodedToken)
 	if err != nil {
 		return Token{}, err
 	}
+	return newToken(encodedToken, msg)
+}
+
+// parseJWS parses the encoded jwt, which must be in compact serialization format with exactly one signature.
+// The JSON serialization is rejected before parsing, as it is not used for bearer tokens and jws.ParseString panics for some malformed ones.
+func parseJWS(encodedToken string) (*jws.Message, error) {
+	if strings.Count(encodedToken, ".") != 2 || strings.HasPrefix(strings.TrimSpace(encodedToken), "{") {
+		return nil, fmt.Errorf("%w: token is not in compact serialization format", ErrMalformedToken)
+	}
+	msg, err := jws.ParseString(encodedToken)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(msg.Signatures()); n != 1 {
+		return nil, fmt.Errorf("%w: token has %d signatures, exactly one is required", ErrMalformedToken, n)
+	}
+	return msg, nil
+}
+
+// newToken creates a Token from the already parsed jws message of the encoded jwt
+func newToken(encodedToken string, msg *jws.Message) (Token, error) {
+	decodedToken := openid.New()
+	if err := json.Unmarshal(msg.Payload(), decodedToken); err != nil {
+		return Token{}, fmt.Errorf("failed to parse token claims: %w", err)
+	}
 
 	return Token{
 		encodedToken: encodedToken,
 		jwtToken:     decodedToken, // encapsulates jwt.token_gen from github.com/lestrrat-go/jwx/jwt
+		alg:          msg.Signatures()[0].ProtectedHeaders().Algorithm(),
 	}, nil
 }
 
@@ -48,22 +102,87 @@ func (t Token) TokenValue() string {
 	return t.encodedToken
 }
 
-// Audience returns "aud" claim, if it doesn't exist empty string is returned
+// VerifiedWithKeyID returns the kid of the JWK which verified the signature of the token, e.g. to monitor key rotations.
+// It is empty if the token has not been validated by the Middleware or has no kid header and was verified with the only key of the JWKs.
+func (t Token) VerifiedWithKeyID() string {
+	return t.verifiedKeyID
+}
+
+// VerifiedIssuer returns the issuer which the Middleware discovered to verify the token, i.e. Issuer(), e.g. for diagnostics of multi-tenant setups.
+// It is empty if the token has not been validated by the Middleware.
+func (t Token) VerifiedIssuer() string {
+	return t.verifiedIssuer
+}
+
+// VerifiedDomain returns the configured domain of the identity which matched the issuer of the token, e.g. "accounts.ondemand.com" for diagnostics.
+// It is empty if the token has not been validated by the Middleware.
+func (t Token) VerifiedDomain() string {
+	return t.verifiedDomain
+}
+
+// Audience returns "aud" claim, if it doesn't exist nil is returned
 func (t Token) Audience() []string {
 	return t.jwtToken.Audience()
 }
 
-// Expiration returns "exp" claim, if it doesn't exist empty string is returned
+// Expiration returns "exp" claim, if it doesn't exist the zero time is returned
 func (t Token) Expiration() time.Time {
 	return t.jwtToken.Expiration()
 }
 
-// IsExpired returns true, if 'exp' claim + leeway time of 1 minute is before current time
+// IsExpired returns true, if 'exp' claim + leeway is before current time. The leeway is the Options.ClockSkew of the Middleware which validated the token, 1 minute by default
 func (t Token) IsExpired() bool {
-	return t.Expiration().Add(1 * time.Minute).Before(time.Now())
+	return t.isExpiredAt(t.now())
+}
+
+// IsValid returns true, if the token is neither expired nor before its 'nbf' claim at the current time, both with the leeway of IsExpired.
+// It is a snapshot of the time-based validity only, e.g. to check a token before forwarding it later; the signature and other claims are validated by the Middleware.
+func (t Token) IsValid() bool {
+	now := t.now()
+	return !t.isExpiredAt(now) && !t.isNotYetValidAt(now)
+}
+
+// isNotYetValidAt reports whether the 'nbf' claim of the token is after the given time, respecting the leeway of IsExpired.
+// It applies the condition of the 'nbf' validation of jwt.Validate with the same leeway, so that both never disagree.
+func (t Token) isNotYetValidAt(now time.Time) bool {
+	nbf := t.NotBefore()
+	if nbf.IsZero() || nbf.Unix() == 0 {
+		return false
+	}
+	now, nbf = now.Truncate(time.Second), nbf.Truncate(time.Second)
+	return !now.Equal(nbf) && !now.After(nbf.Add(-t.leeway()))
+}
+
+// TimeUntilExpiry returns the remaining lifetime of the token until its 'exp' claim, e.g. to align cache TTLs with the token validity.
+// It is negative for expired tokens and does not include the leeway of IsExpired. The current time is taken from Options.Clock of the Middleware which validated the token.
+func (t Token) TimeUntilExpiry() time.Duration {
+	return t.Expiration().Sub(t.now())
+}
+
+// now returns the current time of the clock of the validating Middleware, or time.Now
+func (t Token) now() time.Time {
+	if t.clock == nil {
+		return time.Now()
+	}
+	return t.clock()
 }
 
-// IssuedAt returns "iat" claim, if it doesn't exist empty string is returned
+// isExpiredAt reports whether the token is expired at the given time, respecting the leeway of IsExpired.
+// It applies the condition of the 'exp' validation of jwt.Validate with the same leeway, so that both never disagree, see Middleware.validateClaims.
+// A token without 'exp' claim is expired.
+func (t Token) isExpiredAt(now time.Time) bool {
+	return !now.Truncate(time.Second).Before(t.Expiration().Truncate(time.Second).Add(t.leeway()))
+}
+
+// leeway returns the clock skew of the validating Middleware, or the default clock skew for unverified tokens
+func (t Token) leeway() time.Duration {
+	if t.clock == nil {
+		return defaultClockSkew
+	}
+	return t.clockSkew
+}
+
+// IssuedAt returns "iat" claim, if it doesn't exist the zero time is returned
 func (t Token) IssuedAt() time.Time {
 	return t.jwtToken.IssuedAt()
 }
@@ -77,7 +196,8 @@ func (t Token) CustomIssuer() string {
 	return t.jwtToken.Issuer()
 }
 
-// Issuer returns token issuer with SAP domain; by default "iss" claim is returned or in case it is a custom domain, "ias_iss" is returned
+// Issuer returns token issuer with SAP domain; by default "iss" claim is returned or in case it is a custom domain, "ias_iss" is returned.
+// The Middleware verifies the domain of this issuer and performs the discovery with it, the "iss" claim must match the discovered issuer.
 func (t Token) Issuer() string {
 	// return standard issuer if ias_iss is not set
 	v, err := t.GetClaimAsString(claimIasIssuer)
@@ -87,11 +207,29 @@ func (t Token) Issuer() string {
 	return v
 }
 
-// NotBefore returns "nbf" claim, if it doesn't exist empty string is returned
+// NotBefore returns "nbf" claim, if it doesn't exist the zero time is returned
 func (t Token) NotBefore() time.Time {
 	return t.jwtToken.NotBefore()
 }
 
+// AuthTime returns "auth_time" claim, the time the user authenticated. If it doesn't exist the zero time is returned
+func (t Token) AuthTime() time.Time {
+	switch v, _ := t.jwtToken.Get(claimAuthTime); authTime := v.(type) {
+	case time.Time:
+		return authTime
+	case float64:
+		return time.Unix(int64(authTime), 0)
+	default:
+		return time.Time{}
+	}
+}
+
+// AuthorizedParty returns "azp" claim, if it doesn't exist empty string is returned
+func (t Token) AuthorizedParty() string {
+	v, _ := t.GetClaimAsString(claimAzp)
+	return v
+}
+
 // Subject returns "sub" claim, if it doesn't exist empty string is returned
 func (t Token) Subject() string {
 	return t.jwtToken.Subject()
@@ -115,21 +253,97 @@ func (t Token) Email() string {
 	return v
 }
 
+// Nonce returns "nonce" claim of ID tokens, if it doesn't exist empty string is returned
+func (t Token) Nonce() string {
+	v, _ := t.GetClaimAsString(claimNonce)
+	return v
+}
+
 // ZoneID returns "zone_uuid" claim, if it doesn't exist empty string is returned
 func (t Token) ZoneID() string {
 	v, _ := t.GetClaimAsString(claimSapGlobalZoneID)
 	return v
 }
 
+// AppTID returns the tenant identifier of the "app_tid" claim, or of the legacy "zone_uuid" claim if "app_tid" doesn't exist.
+// If none of them exists empty string is returned
+func (t Token) AppTID() string {
+	if v, err := t.GetClaimAsString(claimAppTID); err == nil && v != "" {
+		return v
+	}
+	return t.ZoneID()
+}
+
 // UserUUID returns "user_uuid" claim, if it doesn't exist empty string is returned
 func (t Token) UserUUID() string {
 	v, _ := t.GetClaimAsString(claimSapGlobalUserID)
 	return v
 }
 
+// Scopes returns the "scope" claim, which is either a space-delimited string or an array, or alternatively the "scopes" claim array.
+// If none of them exists, nil is returned
+func (t Token) Scopes() []string {
+	for _, claim := range []string{claimScope, claimScopes} {
+		if v, err := t.GetClaimAsString(claim); err == nil {
+			return strings.Fields(v)
+		}
+		if v, err := t.GetClaimAsStringSlice(claim); err == nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// HasScope returns true if the provided scope is contained in the token, see Scopes
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AMR returns the authentication methods of the "amr" claim, e.g. "pwd" or "mfa", which is either an array or a space-delimited string.
+// If it doesn't exist, nil is returned
+func (t Token) AMR() []string {
+	if v, err := t.GetClaimAsString(claimAmr); err == nil {
+		return strings.Fields(v)
+	}
+	v, _ := t.GetClaimAsStringSlice(claimAmr)
+	return v
+}
+
+// HasAMR returns true if the user authenticated with the provided method, e.g. "mfa", see AMR
+func (t Token) HasAMR(method string) bool {
+	for _, m := range t.AMR() {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HasLocalScope returns true if the token contains the XSUAA scope of the application, i.e. "<xsappname>.<scope>" with the Options.XSAppName
+// of the Middleware which validated the token, e.g. "Read" matches "my-app!t1234.Read". A fully-qualified scope, which already has the prefix, is matched as is.
+// It returns false, if the Middleware has no XSAppName configured.
+func (t Token) HasLocalScope(scope string) bool {
+	if t.xsAppName == "" {
+		return false
+	}
+	prefix := t.xsAppName + "."
+	if strings.HasPrefix(scope, prefix) {
+		return t.HasScope(scope)
+	}
+	return t.HasScope(prefix + scope)
+}
+
 // ErrClaimNotExists shows that the requested custom claim does not exist in the token
 var ErrClaimNotExists = errors.New("claim does not exist in the token")
 
+// ErrInvalidCnfClaim shows that the 'cnf' claim of the token is no object, or that one of its confirmation members is no string
+var ErrInvalidCnfClaim = errors.New("token provides a malformed cnf claim")
+
 // HasClaim returns true if the provided claim exists in the token
 func (t Token) HasClaim(claim string) bool {
 	_, exists := t.jwtToken.Get(claim)
@@ -149,6 +363,65 @@ func (t Token) GetClaimAsString(claim string) (string, error) {
 	return stringValue, nil
 }
 
+// GetNestedClaimAsString returns a nested custom claim type asserted as string, e.g. GetNestedClaimAsString("ias_apis", "user", "department").
+// Returns error if any element of the path is not available, an intermediate claim is not a map or the leaf is not a string.
+func (t Token) GetNestedClaimAsString(path ...string) (string, error) {
+	value, err := t.getNestedClaim(path)
+	if err != nil {
+		return "", err
+	}
+	stringValue, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("unable to assert claim %s type as string. Actual type: %T", strings.Join(path, "."), value)
+	}
+	return stringValue, nil
+}
+
+// getNestedClaim walks the claims map level by level along the path
+func (t Token) getNestedClaim(path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, ErrClaimNotExists
+	}
+	value, exists := t.jwtToken.Get(path[0])
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrClaimNotExists, path[0])
+	}
+	for i, member := range path[1:] {
+		parent, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unable to assert claim %s type as map[string]interface{}. Actual type: %T", strings.Join(path[:i+1], "."), value)
+		}
+		if value, exists = parent[member]; !exists {
+			return nil, fmt.Errorf("%w: %s", ErrClaimNotExists, strings.Join(path[:i+2], "."))
+		}
+	}
+	return value, nil
+}
+
+// GetClaimAsInt64 returns a custom claim type asserted as int64. JSON numbers are decoded as float64, they are converted if they have no fractional part.
+// Returns error if the claim is not available or not an integral number.
+func (t Token) GetClaimAsInt64(claim string) (int64, error) {
+	value, exists := t.jwtToken.Get(claim)
+	if !exists {
+		return 0, ErrClaimNotExists
+	}
+	switch v := value.(type) {
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("unable to convert claim %s value %v to int64", claim, v)
+		}
+		return int64(v), nil
+	case json.Number:
+		return v.Int64()
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("unable to assert claim %s type as int64. Actual type: %T", claim, value)
+	}
+}
+
 // GetClaimAsStringSlice returns a custom claim type asserted as string slice. The claim name is case sensitive. Returns error if the claim is not available or not an array
 func (t Token) GetClaimAsStringSlice(claim string) ([]string, error) {
 	value, exists := t.jwtToken.Get(claim)
@@ -181,6 +454,20 @@ func (t Token) GetAllClaimsAsMap() map[string]interface{} {
 	return mapClaims
 }
 
+// ClaimsAs decodes all claims of the token into v, e.g. a struct with json tags for a stable token schema, like json.Unmarshal.
+// Time claims like 'exp' are decoded as seconds since the epoch and 'aud' as array. !!! WARNING !!! The claims are not validated again,
+// ClaimsAs only converts the claims of the Token, whose validity depends on how it was obtained, e.g. by Middleware.Authenticate.
+func (t Token) ClaimsAs(v interface{}) error {
+	claims, err := json.Marshal(t.jwtToken)
+	if err != nil {
+		return fmt.Errorf("failed to encode token claims: %w", err)
+	}
+	if err := json.Unmarshal(claims, v); err != nil {
+		return fmt.Errorf("failed to decode token claims: %w", err)
+	}
+	return nil
+}
+
 // GetClaimAsMap returns a map of all members and its values of a custom claim in the token. The member name is case sensitive. Returns error if the claim is not available or not a map
 func (t Token) GetClaimAsMap(claim string) (map[string]interface{}, error) {
 	value, exists := t.jwtToken.Get(claim)
@@ -198,14 +485,23 @@ func (t Token) getJwtToken() jwt.Token {
 	return t.jwtToken
 }
 
-func (t Token) getCnfClaimMember(memberName string) string {
+// getCnfClaimMember returns the confirmation member of the 'cnf' claim, or an empty string if the token has no such member.
+// It returns ErrInvalidCnfClaim if the claim or the member is of unexpected type.
+func (t Token) getCnfClaimMember(memberName string) (string, error) {
 	cnfClaim, err := t.GetClaimAsMap(claimCnf)
-	if errors.Is(err, ErrClaimNotExists) || cnfClaim == nil {
-		return ""
+	if errors.Is(err, ErrClaimNotExists) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCnfClaim, err)
 	}
 	res, ok := cnfClaim[memberName]
-	if ok {
-		return res.(string)
+	if !ok {
+		return "", nil
+	}
+	member, ok := res.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: member %s is of type %T instead of string", ErrInvalidCnfClaim, memberName, res)
 	}
-	return ""
+	return member, nil
 }
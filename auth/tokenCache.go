@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+const defaultTokenCacheMaxSize = 1000
+
+// cachedToken is a successfully validated Token together with the keys its signature was verified with
+type cachedToken struct {
+	token Token
+	jwks  jwk.Set
+}
+
+// tokenCache is a size-bounded cache of validated tokens, keyed by the hash of the encoded token.
+// If the cache is full, the least recently used token is evicted.
+type tokenCache struct {
+	tokens *lruCache // contains *cachedToken
+}
+
+func newTokenCache(maxSize int) *tokenCache {
+	return &tokenCache{tokens: newLRUCache(maxSize)}
+}
+
+// tokenCacheKey hashes the encoded token, so that the cache does not hold the bearer token as key
+func tokenCacheKey(rawToken string) string {
+	hash := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// get returns the cached token for rawToken, or false if it is not cached or expired at now
+func (c *tokenCache) get(rawToken string, now time.Time) (*cachedToken, bool) {
+	key := tokenCacheKey(rawToken)
+	entry, _, found := c.tokens.get(key)
+	if !found {
+		return nil, false
+	}
+	cached := entry.(*cachedToken)
+	if cached.token.isExpiredAt(now) {
+		c.tokens.delete(key)
+		return nil, false
+	}
+	return cached, true
+}
+
+// add caches the token which has been verified with jwks
+func (c *tokenCache) add(token Token, jwks jwk.Set) {
+	c.tokens.set(tokenCacheKey(token.TokenValue()), &cachedToken{token: token, jwks: jwks}, token.Expiration())
+}
+
+// remove deletes the cached token for rawToken, e.g. because its keys have been rotated
+func (c *tokenCache) remove(rawToken string) {
+	c.tokens.delete(tokenCacheKey(rawToken))
+}
+
+// flush deletes all cached tokens
+func (c *tokenCache) flush() {
+	c.tokens.flush()
+}
+
+// len returns the number of cached tokens
+func (c *tokenCache) len() int {
+	return c.tokens.len()
+}
@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+func TestTokenCache_evictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	newCachedToken := func(raw string) Token {
+		jwtToken := jwt.New()
+		_ = jwtToken.Set(jwt.ExpirationKey, now.Add(time.Hour))
+		return Token{encodedToken: raw, jwtToken: jwtToken}
+	}
+	c := newTokenCache(2)
+	c.add(newCachedToken("first"), nil)
+	c.add(newCachedToken("second"), nil)
+	if _, found := c.get("first", now); !found {
+		t.Fatalf("expected first token to be cached")
+	}
+	c.add(newCachedToken("third"), nil)
+
+	if _, found := c.get("second", now); found {
+		t.Errorf("expected least recently used token to be evicted")
+	}
+	for _, raw := range []string{"first", "third"} {
+		if _, found := c.get(raw, now); !found {
+			t.Errorf("expected %s token to be cached", raw)
+		}
+	}
+	if _, found := c.get("first", now.Add(2*time.Hour)); found {
+		t.Errorf("expected expired token to be a cache miss")
+	}
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrNoUserInfoEndpoint is returned by FetchUserInfo if the discovery document of the token issuer has no userinfo_endpoint
+var ErrNoUserInfoEndpoint = errors.New("issuer provides no userinfo endpoint")
+
+// UserInfoError represents a failed request to the userinfo endpoint, e.g. with StatusCode 401 if the token is not accepted
+type UserInfoError struct {
+	// StatusCode of the failed request
+	StatusCode int
+	url        string
+	errTxt     string
+}
+
+// Error returns the status code and payload of the failed request
+func (e *UserInfoError) Error() string {
+	return fmt.Sprintf("userinfo request to '%v' failed with status code '%v' and payload: '%v'", e.url, e.StatusCode, e.errTxt)
+}
+
+// FetchUserInfo requests the claims of the user from the userinfo_endpoint of the token issuer with the token as bearer, e.g. profile claims which are not part of the token.
+// The token should be validated before, at least the domain of its issuer is verified to not send it to an untrusted server.
+// The userinfo_endpoint must be in the trusted domains of the issuer, otherwise ErrUntrustedEndpoint is returned.
+// Responses other than 200 are returned as *UserInfoError, use errors.As to check the StatusCode. Responses are read up to 1 MiB.
+func (m *Middleware) FetchUserInfo(ctx context.Context, t Token) (_ map[string]interface{}, err error) {
+	ctx, span := m.tracer.Start(ctx, "auth.FetchUserInfo")
+	defer func() { endSpan(span, err) }()
+
+	oidcTenant, err := m.getOIDCTenant(ctx, t.Issuer(), t.CustomIssuer())
+	if err != nil {
+		return nil, err
+	}
+	userInfoURL := oidcTenant.ProviderJSON.UserInfoURL
+	if userInfoURL == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoUserInfoEndpoint, t.Issuer())
+	}
+	// the token is sent to the endpoint, a tampered discovery must not redirect it outside of the trusted domains
+	if err := m.verifyEndpointURL(t.Issuer(), userInfoURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userInfoURL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct userinfo request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+t.TokenValue())
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to perform userinfo request: %w", err)
+	}
+	defer resp.Body.Close()
+	body := io.LimitReader(resp.Body, maxResponseBytes)
+	if resp.StatusCode != http.StatusOK {
+		errTxt, _ := io.ReadAll(body)
+		return nil, &UserInfoError{StatusCode: resp.StatusCode, url: userInfoURL, errTxt: string(errTxt)}
+	}
+	var userInfo map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("error parsing userinfo response from %v: %w", userInfoURL, err)
+	}
+	return userInfo, nil
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/env"
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+func TestFetchUserInfo(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	token, err := middleware.ValidateToken(context.Background(), oidcMockServer.MustSignToken(t, map[string]interface{}{"email": "john.doe@example.org"}))
+	require.NoError(t, err)
+
+	userInfo, err := middleware.FetchUserInfo(context.Background(), token)
+	require.NoError(t, err)
+	assert.Equal(t, "john.doe@example.org", userInfo["email"])
+	assert.Equal(t, "Foo", userInfo["given_name"])
+}
+
+func TestFetchUserInfo_rejected(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	// the userinfo endpoint rejects the token with the forged signature
+	parts := strings.Split(oidcMockServer.MustSignToken(t, nil), ".")
+	token, err := ParseUnverified(parts[0] + "." + parts[1] + ".Zm9yZ2Vk")
+	require.NoError(t, err)
+
+	_, err = middleware.FetchUserInfo(context.Background(), token)
+	var userInfoErr *UserInfoError
+	require.True(t, errors.As(err, &userInfoErr), "unexpected error %v", err)
+	assert.Equal(t, http.StatusUnauthorized, userInfoErr.StatusCode)
+}
+
+func TestFetchUserInfo_untrustedIssuer(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	middleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	token, err := ParseUnverified(oidcMockServer.MustSignToken(t, map[string]interface{}{"iss": "https://untrusted.example.org"}))
+	require.NoError(t, err)
+
+	_, err = middleware.FetchUserInfo(context.Background(), token)
+	assert.ErrorIs(t, err, ErrUntrustedIssuer)
+	assert.Equal(t, 0, oidcMockServer.WellKnownHitCounter)
+}
+
+func TestFetchUserInfo_responseTooLarge(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/userinfo" {
+			_, _ = fmt.Fprintf(w, `{"padding":"%s"}`, strings.Repeat("a", maxResponseBytes))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"issuer":"https://%[1]s","jwks_uri":"https://%[1]s/oauth2/certs","userinfo_endpoint":"https://%[1]s/userinfo"}`, r.Host)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	middleware := NewMiddleware(env.DefaultIdentity{ClientID: "clientid", Domains: []string{serverURL.Host}}, Options{HTTPClient: server.Client()})
+	defer middleware.Close()
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	token, err := ParseUnverified(oidcMockServer.MustSignToken(t, map[string]interface{}{"iss": server.URL}))
+	require.NoError(t, err)
+
+	_, err = middleware.FetchUserInfo(context.Background(), token)
+	assert.ErrorContains(t, err, "error parsing userinfo response")
+}
+
+func TestFetchUserInfo_untrustedEndpoint(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"issuer":"https://%[1]s","jwks_uri":"https://%[1]s/oauth2/certs","userinfo_endpoint":"https://attacker.example.com/userinfo"}`, r.Host)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	middleware := NewMiddleware(env.DefaultIdentity{ClientID: "clientid", Domains: []string{serverURL.Host}}, Options{HTTPClient: server.Client()})
+	defer middleware.Close()
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	token, err := ParseUnverified(oidcMockServer.MustSignToken(t, map[string]interface{}{"iss": server.URL}))
+	require.NoError(t, err)
+
+	_, err = middleware.FetchUserInfo(context.Background(), token)
+	assert.ErrorIs(t, err, ErrUntrustedEndpoint)
+}
@@ -5,99 +5,533 @@
 package auth
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jws"
 	"github.com/lestrrat-go/jwx/jwt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 
+	"github.com/sap/cloud-security-client-go/env"
 	"github.com/sap/cloud-security-client-go/oidcclient"
 )
 
+// Errors returned by the token validation. They are wrapped with additional details, use errors.Is to check for them.
+var (
+	ErrTokenExpired     = errors.New("token is expired")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrInvalidSignature = errors.New("token signature is invalid")
+	ErrUntrustedIssuer  = errors.New("token issuer is not trusted")
+	ErrInvalidAudience  = errors.New("token audience is not accepted")
+	ErrAzpMismatch      = errors.New("token azp does not match the client id")
+	ErrMissingAlg       = errors.New("alg is missing from jwt header")
+	ErrDisallowedAlg    = errors.New("alg of jwt header is not allowed")
+	ErrKeyNotFound      = errors.New("no matching jwk found for token")
+	ErrWeakKey          = errors.New("jwk does not meet the minimum key size")
+	ErrKeyConstruction  = errors.New("unable to construct public key from jwk")
+	ErrMalformedToken   = errors.New("token is malformed")
+	ErrAuthTooOld       = errors.New("token auth_time exceeds the maximum authentication age")
+	ErrMissingAMR       = errors.New("token amr lacks a required authentication method")
+	ErrNotSubscribed    = errors.New("token tenant is not subscribed")
+	ErrInactiveToken    = errors.New("token is not active according to the introspection endpoint")
+	ErrNonceMismatch    = errors.New("token nonce does not match the expected nonce")
+	ErrUntrustedJWKsURL = errors.New("jwks_uri of the discovery is not in the trusted domains of the issuer")
+	// ErrUntrustedEndpoint is returned if the discovered introspection_endpoint or userinfo_endpoint is not in the trusted domains of the issuer,
+	// so that a tampered discovery can't obtain the client secret with an introspection or the token with a userinfo request
+	ErrUntrustedEndpoint = errors.New("endpoint of the discovery is not in the trusted domains of the issuer")
+	// ErrInsufficientScope signals that a valid token lacks a required scope, the DefaultErrorHandler responds with 403
+	ErrInsufficientScope = errors.New("token does not provide the required scope")
+)
+
 // parseAndValidateJWT parses the token into its claims, verifies the claims and verifies the signature
-func (m *Middleware) parseAndValidateJWT(rawToken string) (Token, error) {
-	token, err := NewToken(rawToken)
+func (m *Middleware) parseAndValidateJWT(ctx context.Context, rawToken string) (_ Token, err error) {
+	ctx, span := m.tracer.Start(ctx, "auth.parseAndValidateJWT")
+	defer func() { endSpan(span, err) }()
+
+	if m.tokenCache != nil {
+		if token, ok := m.getCachedToken(ctx, rawToken); ok {
+			span.SetAttributes(attribute.Bool("cached", true))
+			return token, nil
+		}
+	}
+
+	// the encoded token is decoded only once, its message is shared by the claim and signature verification
+	msg, err := parseJWS(rawToken)
 	if err != nil {
+		if isUnsecuredJWT(rawToken) {
+			return Token{}, fmt.Errorf("%w: %v", ErrDisallowedAlg, err)
+		}
+		if m.options.EnableIntrospection && !isJWTShaped(rawToken) {
+			// the signature of opaque tokens can't be verified, the introspection endpoint decides about them. Malformed jwts are rejected
+			return m.introspect(ctx, rawToken)
+		}
+		return Token{}, err
+	}
+	token, err := newToken(rawToken, msg)
+	if err != nil {
+		return Token{}, err
+	}
+	m.bindToken(&token)
+	span.SetAttributes(attribute.String("issuer", token.Issuer()))
+
+	// fail early to avoid discovering the issuer and fetching keys for an unverifiable token
+	if err := m.verifyAlgorithm(token.alg); err != nil {
 		return Token{}, err
 	}
 
 	// get keyset
-	keySet, err := m.getOIDCTenant(token.Issuer(), token.CustomIssuer())
+	keySet, err := m.getKeySet(ctx, token)
 	if err != nil {
 		return Token{}, err
 	}
 
 	// verify claims
-	if err := m.validateClaims(token, keySet); err != nil {
+	if err := m.validateClaims(ctx, token, keySet); err != nil {
 		return Token{}, err
 	}
 
 	// verify signature
-	if err := m.verifySignature(token, keySet); err != nil {
+	jwks, err := m.verifySignature(ctx, token, msg.Signatures()[0], keySet)
+	if err != nil {
 		return Token{}, err
 	}
+	// the key is looked up by the kid header, it remains empty for tokens verified with the only key of the jwks
+	token.verifiedKeyID = msg.Signatures()[0].ProtectedHeaders().KeyID()
+	token.verifiedIssuer = token.Issuer()
+	token.verifiedDomain = m.trustedDomain(token.Issuer())
 
+	if m.tokenCache != nil {
+		m.tokenCache.add(token, jwks)
+	}
 	return token, nil
 }
 
-func (m *Middleware) verifySignature(t Token, keySet *oidcclient.OIDCTenant) (err error) {
-	headers, err := getHeaders(t.TokenValue())
+// bindToken attaches the settings of the Middleware, which the Token methods depend on, to the token which is validated by it
+func (m *Middleware) bindToken(t *Token) {
+	t.clock = m.options.Clock
+	t.clockSkew = m.options.ClockSkew
+	t.xsAppName = m.options.XSAppName
+}
+
+// getCachedToken returns the token if it has been validated before. The claims are validated again, only the signature verification is skipped.
+// The cached token is dropped if the keys of its issuer changed since, e.g. after a key rotation.
+func (m *Middleware) getCachedToken(ctx context.Context, rawToken string) (_ Token, hit bool) {
+	defer func() { m.tokenCache.tokens.recordLookup(hit) }()
+
+	cached, found := m.tokenCache.get(rawToken, m.options.Clock())
+	if !found {
+		return Token{}, false
+	}
+	keySet, err := m.getKeySet(ctx, cached.token)
 	if err != nil {
-		return err
+		return Token{}, false
 	}
-	alg := headers.Algorithm()
+	if err := m.validateClaims(ctx, cached.token, keySet); err != nil {
+		m.tokenCache.remove(rawToken)
+		return Token{}, false
+	}
+	if keySet == nil {
+		// the keys of the KeyFunc and the SymmetricKey are not observable, the token stays cached until its expiry
+		return cached.token, true
+	}
+	if jwks, err := keySet.GetJWKs(ctx, cached.token.ZoneID()); err != nil || jwks != cached.jwks {
+		m.tokenCache.remove(rawToken)
+		return Token{}, false
+	}
+	return cached.token, true
+}
+
+// getKeySet returns the OIDC tenant of the token issuer. If Options.KeyFunc is set, only the domain of the issuer is verified and nil is returned.
+// Nil is returned as well for HMAC signed tokens of Options.SymmetricKeyIssuer.
+func (m *Middleware) getKeySet(ctx context.Context, t Token) (*oidcclient.OIDCTenant, error) {
+	if isSymmetricAlgorithm(t.alg) {
+		// HMAC signed tokens are only verified with Options.SymmetricKey and never discovered, their issuer must be the configured one
+		if len(m.options.SymmetricKey) == 0 {
+			return nil, fmt.Errorf("%w: %s requires Options.SymmetricKey", ErrDisallowedAlg, t.alg)
+		}
+		if t.Issuer() != m.options.SymmetricKeyIssuer {
+			return nil, fmt.Errorf("%w: %s signed token of issuer '%s' is not issued by Options.SymmetricKeyIssuer", ErrUntrustedIssuer, t.alg, t.Issuer())
+		}
+		return nil, nil
+	}
+	if m.options.KeyFunc != nil {
+		_, err := m.verifyIssuer(t.Issuer())
+		return nil, err
+	}
+	return m.getOIDCTenant(ctx, t.Issuer(), t.CustomIssuer())
+}
 
-	// fail early to avoid another parsing of encoded token
+// verifyAlgorithm rejects tokens without alg header or with an algorithm which is not one of Options.AllowedAlgorithms
+func (m *Middleware) verifyAlgorithm(alg jwa.SignatureAlgorithm) error {
 	if alg == "" {
-		return errors.New("alg is missing from jwt header")
+		return ErrMissingAlg
+	}
+	// unsigned tokens are never accepted, even if allowed by misconfiguration
+	if strings.EqualFold(alg.String(), jwa.NoSignature.String()) {
+		return fmt.Errorf("%w: %s", ErrDisallowedAlg, alg)
+	}
+	if !m.isAllowedAlgorithm(alg) {
+		return fmt.Errorf("%w: %s", ErrDisallowedAlg, alg)
+	}
+	return nil
+}
+
+// verifySignature verifies the signature of the token and returns the keys it was verified with
+func (m *Middleware) verifySignature(ctx context.Context, t Token, sig *jws.Signature, keySet *oidcclient.OIDCTenant) (jwks jwk.Set, err error) {
+	ctx, span := m.tracer.Start(ctx, "auth.verifySignature")
+	defer func() { endSpan(span, err) }()
+
+	headers := sig.ProtectedHeaders()
+	alg := headers.Algorithm()
+	span.SetAttributes(attribute.String("alg", alg.String()), attribute.String("kid", headers.KeyID()))
+
+	// the algorithm has been checked by verifyAlgorithm before
+	if isSymmetricAlgorithm(alg) {
+		return nil, verifySignatureWithKey(t, sig, alg, m.options.SymmetricKey)
 	}
 
-	// parse and verify signature
-	jwks, err := keySet.GetJWKs(t.ZoneID())
+	// verify signature
+	key, jwks, err := m.lookupKey(ctx, t, headers.KeyID(), keySet)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	publicKey, err := rawPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyKeyAlgorithm(key, alg); err != nil {
+		return nil, err
+	}
+	if err := m.validateKeySize(publicKey); err != nil {
+		return nil, err
+	}
+	if err := verifySignatureWithKey(t, sig, alg, publicKey); err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
+
+// verifySignatureWithKey verifies the signature of the token with the raw key, i.e. a public key or the []byte secret of HMAC algorithms
+func verifySignatureWithKey(t Token, sig *jws.Signature, alg jwa.SignatureAlgorithm, key interface{}) error {
+	verifier, err := jws.NewVerifier(alg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
 	}
-	_, err = jwt.ParseString(t.TokenValue(), jwt.WithKeySet(jwks), jwt.UseDefaultKey(true))
+	signingInput, err := getSigningInput(t.TokenValue())
 	if err != nil {
 		return err
 	}
+	if err = verifier.Verify(signingInput, sig.Signature(), key); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
 	return nil
 }
 
-func getHeaders(encodedToken string) (jws.Headers, error) {
-	msg, err := jws.Parse([]byte(encodedToken))
+// lookupKey returns the key of the token by its kid from the jwks of keySet, or the key resolved by Options.KeyFunc if set
+func (m *Middleware) lookupKey(ctx context.Context, t Token, kid string, keySet *oidcclient.OIDCTenant) (jwk.Key, jwk.Set, error) {
+	if m.options.KeyFunc != nil {
+		key, err := m.options.KeyFunc(ctx, t)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrKeyNotFound, err)
+		}
+		if key == nil {
+			return nil, nil, fmt.Errorf("%w: KeyFunc returned no key", ErrKeyNotFound)
+		}
+		return key, nil, nil
+	}
+
+	jwks, err := keySet.GetJWKs(ctx, t.ZoneID())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	key, err := getPublicKey(jwks, kid)
+	if errors.Is(err, ErrKeyNotFound) && kid != "" {
+		// the cached keys might be outdated after a key rotation, retry once with refreshed keys
+		m.options.MetricsRecorder.IncJWKsRefresh()
+		atomic.AddUint64(&m.jwksRefreshes, 1)
+		m.options.Logger.Debug("refreshing jwks", "issuer", keySet.ProviderJSON.Issuer, "kid", kid)
+		if jwks, err = keySet.RefreshJWKs(ctx, t.ZoneID()); err != nil {
+			return nil, nil, err
+		}
+		key, err = getPublicKey(jwks, kid)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, jwks, nil
+}
+
+// isJWTShaped reports whether the token has the format of a jwt, i.e. the compact or JSON serialization. Opaque tokens have neither.
+func isJWTShaped(rawToken string) bool {
+	return strings.Count(rawToken, ".") == 2 || strings.HasPrefix(strings.TrimSpace(rawToken), "{")
+}
+
+// isUnsecuredJWT reports whether the jwt header declares the "none" algorithm in any case.
+// jws.ParseString rejects unknown alg values like "NONE" with a generic error, this allows to report them as ErrDisallowedAlg.
+func isUnsecuredJWT(rawToken string) bool {
+	encodedHeader := strings.SplitN(rawToken, ".", 2)[0]
+	decodedHeader, err := base64.RawURLEncoding.DecodeString(encodedHeader)
+	if err != nil {
+		return false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(decodedHeader, &header); err != nil {
+		return false
+	}
+	return strings.EqualFold(header.Alg, jwa.NoSignature.String())
+}
+
+// verifyKeyAlgorithm binds the key to the algorithm of the token to prevent algorithm confusion,
+// e.g. a RSA key of the JWKs never verifies an HS256 token which was signed with the public key as secret.
+func verifyKeyAlgorithm(key jwk.Key, alg jwa.SignatureAlgorithm) error {
+	var keyType jwa.KeyType
+	switch alg {
+	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512:
+		keyType = jwa.RSA
+	case jwa.ES256, jwa.ES384, jwa.ES512, jwa.ES256K:
+		keyType = jwa.EC
+	case jwa.EdDSA:
+		keyType = jwa.OKP
+	}
+	if keyType == "" || key.KeyType() != keyType {
+		return fmt.Errorf("%w: %s must not be verified with key type '%s' of kid %s", ErrInvalidSignature, alg, key.KeyType(), key.KeyID())
+	}
+	if key.Algorithm() != "" && key.Algorithm() != alg.String() {
+		return fmt.Errorf("%w: %s must not be verified with kid %s, which is intended for %s", ErrInvalidSignature, alg, key.KeyID(), key.Algorithm())
+	}
+	return nil
+}
+
+// isSymmetricAlgorithm reports whether alg is a HMAC algorithm, i.e. verified with the shared Options.SymmetricKey instead of a public key
+func isSymmetricAlgorithm(alg jwa.SignatureAlgorithm) bool {
+	return alg == jwa.HS256 || alg == jwa.HS384 || alg == jwa.HS512
+}
+
+func (m *Middleware) isAllowedAlgorithm(alg jwa.SignatureAlgorithm) bool {
+	for _, allowed := range m.options.AllowedAlgorithms {
+		if alg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// rawPublicKey returns the public key of the jwk and checks its key material, which is not validated when the jwks are parsed,
+// e.g. an empty RSA modulus or an EC point which is not on the curve.
+func rawPublicKey(key jwk.Key) (interface{}, error) {
+	var publicKey interface{}
+	if err := key.Raw(&publicKey); err != nil {
+		return nil, fmt.Errorf("%w: kid %s: %v", ErrKeyConstruction, key.KeyID(), err)
 	}
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		if k.N == nil || k.N.Sign() <= 0 || k.E < 2 {
+			return nil, fmt.Errorf("%w: kid %s: invalid rsa modulus or exponent", ErrKeyConstruction, key.KeyID())
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve == nil || k.X == nil || k.Y == nil || !k.Curve.IsOnCurve(k.X, k.Y) {
+			return nil, fmt.Errorf("%w: kid %s: ec point is not on curve", ErrKeyConstruction, key.KeyID())
+		}
+	case ed25519.PublicKey:
+		if len(k) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: kid %s: ed25519 key has %d bytes", ErrKeyConstruction, key.KeyID(), len(k))
+		}
+	default:
+		return nil, fmt.Errorf("%w: kid %s: unsupported key type %T", ErrKeyConstruction, key.KeyID(), publicKey)
+	}
+	return publicKey, nil
+}
+
+// validateKeySize rejects RSA keys with a modulus smaller than Options.MinRSAKeyBits, e.g. weak keys of a misconfigured tenant
+func (m *Middleware) validateKeySize(publicKey interface{}) error {
+	rsaKey, isRSA := publicKey.(*rsa.PublicKey)
+	if !isRSA {
+		return nil
+	}
+	if bits := rsaKey.N.BitLen(); bits < m.options.MinRSAKeyBits {
+		return fmt.Errorf("%w: rsa key has %d bits, at least %d bits are required", ErrWeakKey, bits, m.options.MinRSAKeyBits)
+	}
+	return nil
+}
+
+// getSigningInput returns the encoded header and payload of a compact serialized jwt, which are covered by its signature
+func getSigningInput(encodedToken string) ([]byte, error) {
+	i := strings.LastIndexByte(encodedToken, '.')
+	if i < 0 {
+		return nil, fmt.Errorf("%w: token is not in compact serialization format", ErrInvalidSignature)
+	}
+	return []byte(encodedToken[:i]), nil
+}
 
-	return msg.Signatures()[0].ProtectedHeaders(), nil
+// getPublicKey returns the jwk referenced by kid. If the token has no kid, the only key of the set is used.
+func getPublicKey(jwks jwk.Set, kid string) (jwk.Key, error) {
+	if kid == "" {
+		if jwks.Len() != 1 {
+			return nil, fmt.Errorf("%w: kid is missing from jwt header and jwks provides %d keys", ErrKeyNotFound, jwks.Len())
+		}
+		key, _ := jwks.Get(0)
+		return key, nil
+	}
+	key, found := jwks.LookupKeyID(kid)
+	if !found {
+		return nil, fmt.Errorf("%w: kid %s is specified in token, but no jwk provided by server", ErrKeyNotFound, kid)
+	}
+	return key, nil
 }
 
-func (m *Middleware) validateClaims(t Token, ks *oidcclient.OIDCTenant) error { // performing IsExpired check, because dgriljalva jwt.Validate() doesn't fail on missing 'exp' claim
+func (m *Middleware) validateClaims(ctx context.Context, t Token, ks *oidcclient.OIDCTenant) error { // performing IsExpired check, because dgriljalva jwt.Validate() doesn't fail on missing 'exp' claim
 	// performing IsExpired check, because lestrrat-go jwt.Validate() doesn't fail on missing 'exp' claim
-	if t.IsExpired() {
-		return fmt.Errorf("token is expired, exp: %v", t.Expiration())
+	if t.isExpiredAt(m.options.Clock()) {
+		return fmt.Errorf("%w, exp: %v", ErrTokenExpired, t.Expiration())
+	}
+	if iss := t.getJwtToken().Issuer(); ks != nil && iss != ks.ProviderJSON.Issuer {
+		return fmt.Errorf("%w: iss %s does not match the discovered issuer %s", ErrUntrustedIssuer, iss, ks.ProviderJSON.Issuer)
+	}
+	if err := m.validateAudience(ctx, t, t.Audience(), m.clientIDsOfIssuer(t.Issuer())); err != nil {
+		return err
+	}
+	if m.options.IsSubscribed != nil && m.isConsumerTenant(t) && !m.options.IsSubscribed(t.AppTID()) {
+		return fmt.Errorf("%w: app_tid %s", ErrNotSubscribed, t.AppTID())
+	}
+	for _, method := range m.options.RequiredAMR {
+		if !t.HasAMR(method) {
+			return fmt.Errorf("%w: amr %v does not contain %q", ErrMissingAMR, t.AMR(), method)
+		}
+	}
+	if m.options.MaxAuthAge > 0 {
+		if err := m.validateAuthTime(t); err != nil {
+			return err
+		}
 	}
 	err := jwt.Validate(t.getJwtToken(),
-		jwt.WithAudience(m.identity.GetClientID()),
-		jwt.WithIssuer(ks.ProviderJSON.Issuer),
-		jwt.WithAcceptableSkew(1*time.Minute)) // to keep leeway in sync with Token.IsExpired
+		jwt.WithClock(jwt.ClockFunc(m.options.Clock)),
+		jwt.WithAcceptableSkew(t.leeway())) // the single leeway of the token, which Token.IsExpired applies as well
 
+	if errors.Is(err, jwt.ErrTokenExpired()) {
+		return fmt.Errorf("%w: %v", ErrTokenExpired, err)
+	}
+	if errors.Is(err, jwt.ErrTokenNotYetValid()) {
+		return fmt.Errorf("%w, nbf: %v", ErrTokenNotYetValid, t.NotBefore())
+	}
 	if err != nil {
 		return fmt.Errorf("claim validation failed: %v", err)
 	}
 	return nil
 }
 
+// validateAudience requires one of audiences to be expected by the context, see WithExpectedAudiences, or to be one of the clientIDs or Options.AcceptedAudiences.
+// If Options.VerifyAzp is set, tokens with multiple audiences must be authorized for one of the clientIDs as well.
+func (m *Middleware) validateAudience(ctx context.Context, t Token, audiences, clientIDs []string) error {
+	if expected, ok := expectedAudiencesFromContext(ctx); ok {
+		if !intersects(audiences, expected) {
+			return fmt.Errorf("%w: aud %v contains none of the expected audiences %v", ErrInvalidAudience, audiences, expected)
+		}
+	} else if !m.options.SkipAudienceValidation && !m.isAcceptedAudience(audiences, clientIDs) {
+		return fmt.Errorf("%w: aud %v contains neither the client id nor an accepted audience", ErrInvalidAudience, audiences)
+	}
+	if m.options.VerifyAzp && len(t.Audience()) > 1 && !contains(clientIDs, t.AuthorizedParty()) {
+		return fmt.Errorf("%w: azp %q of token with multiple audiences", ErrAzpMismatch, t.AuthorizedParty())
+	}
+	return nil
+}
+
+// validateAuthTime requires the "auth_time" claim to be within Options.MaxAuthAge, respecting the leeway of the expiry check
+func (m *Middleware) validateAuthTime(t Token) error {
+	authTime := t.AuthTime()
+	if authTime.IsZero() {
+		return fmt.Errorf("%w: auth_time is missing", ErrAuthTooOld)
+	}
+	if age := m.options.Clock().Sub(authTime); age > m.options.MaxAuthAge+t.leeway() {
+		return fmt.Errorf("%w: user authenticated %v ago, at most %v is accepted", ErrAuthTooOld, age.Round(time.Second), m.options.MaxAuthAge)
+	}
+	return nil
+}
+
+// isConsumerTenant reports whether the token was issued for another tenant than the provider tenant, i.e. the zone of the identity
+func (m *Middleware) isConsumerTenant(t Token) bool {
+	providerZone := m.identity.GetZoneUUID()
+	return providerZone == uuid.Nil || !strings.EqualFold(t.AppTID(), providerZone.String())
+}
+
+// isAcceptedAudience reports whether any of the token audiences is one of clientIDs or of Options.AcceptedAudiences
+func (m *Middleware) isAcceptedAudience(audiences, clientIDs []string) bool {
+	for _, aud := range audiences {
+		if contains(clientIDs, aud) || contains(m.options.AcceptedAudiences, aud) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIDsOfIssuer returns the client ids of the identities whose domains match the issuer, see Options.AdditionalIdentities
+func (m *Middleware) clientIDsOfIssuer(issuer string) []string {
+	if len(m.options.SymmetricKey) > 0 && issuer == m.options.SymmetricKeyIssuer {
+		// tokens of internal services are issued for the application itself
+		return []string{m.identity.GetClientID()}
+	}
+	issURI, err := url.Parse(issuer)
+	if err != nil {
+		return nil
+	}
+	var clientIDs []string
+	for _, identity := range m.identities() {
+		if matchesDomain(issURI.Host, identity.GetDomains()) {
+			clientIDs = append(clientIDs, identity.GetClientID())
+		}
+	}
+	return clientIDs
+}
+
+// identities returns the identity of the Middleware followed by Options.AdditionalIdentities
+func (m *Middleware) identities() []env.Identity {
+	return append([]env.Identity{m.identity}, m.options.AdditionalIdentities...)
+}
+
+// intersects reports whether any of values is contained in others
+func intersects(values, others []string) bool {
+	for _, v := range values {
+		if contains(others, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // getOIDCTenant returns an OIDC Tenant with discovered .well-known/openid-configuration.
 //
 // issuer is the trusted ias issuer with SAP domain of the incoming token (token.Issuer())
 //
 // customIssuer represents the custom issuer of the incoming token if given (token.CustomIssuer())
-func (m *Middleware) getOIDCTenant(issuer, customIssuer string) (*oidcclient.OIDCTenant, error) {
+func (m *Middleware) getOIDCTenant(ctx context.Context, issuer, customIssuer string) (_ *oidcclient.OIDCTenant, err error) {
+	ctx, span := m.tracer.Start(ctx, "auth.getOIDCTenant", trace.WithAttributes(attribute.String("issuer", issuer)))
+	defer func() { endSpan(span, err) }()
+
 	issURI, err := m.verifyIssuer(issuer)
 	if err != nil {
 		return nil, err
@@ -108,19 +542,76 @@ func (m *Middleware) getOIDCTenant(issuer, customIssuer string) (*oidcclient.OID
 		tokenIssuer = issuer
 	}
 
-	oidcTenant, exp, found := m.oidcTenants.GetWithExpiration(issuer)
+	oidcTenant, exp, found := m.oidcTenants.get(issuer)
 	// redo discovery if not found, cache expired, or tokenIssuer is not the same as Issuer on providerJSON (e.g. custom domain config just changed for that tenant)
-	if !found || time.Now().After(exp) || oidcTenant.(*oidcclient.OIDCTenant).ProviderJSON.Issuer != tokenIssuer {
-		newKeySet, err, _ := m.sf.Do(issuer, func() (i interface{}, err error) {
-			set, err := oidcclient.NewOIDCTenant(m.options.HTTPClient, issURI)
+	outdated := !found || m.options.Clock().After(exp) || oidcTenant.(*oidcclient.OIDCTenant).ProviderJSON.Issuer != tokenIssuer
+	// outdated tenants are misses, like in CacheStats
+	m.options.MetricsRecorder.IncCacheLookup(!outdated)
+	m.oidcTenants.recordLookup(!outdated)
+	if outdated {
+		// fail fast for issuers whose discovery failed recently, instead of retrying the network round trip on every request
+		if failure, failedUntil, failed := m.failedDiscoveries.get(issuer); failed && m.options.Clock().Before(failedUntil) {
+			return nil, fmt.Errorf("token is unverifiable: unable to perform oidc discovery (retry after %v): %w", failedUntil, failure.(error))
+		}
+		// the caller waits for the shared discovery only as long as its own context allows.
+		// Discoveries are shared per cache generation, so that requests after an invalidation never join a discovery which started before.
+		generation := m.generations.of(issuer)
+		resultCh := m.sf.DoChan(generation+"/"+issuer, func() (i interface{}, err error) {
+			// the discovery is shared by all callers, so it must not be aborted by the context of the first one. Only its span is kept
+			discoveryCtx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), discoveryTimeout)
+			defer cancel()
+			start := time.Now()
+			set, err := oidcclient.NewOIDCTenantWithOptions(discoveryCtx, m.options.HTTPClient, issURI, oidcclient.Options{
+				Retries:        m.options.DiscoveryRetries,
+				RetryBaseDelay: m.options.DiscoveryRetryBaseDelay,
+				MaxRetryAfter:  m.options.DiscoveryMaxRetryAfter,
+				JWKsURL:        m.options.JWKsURL,
+				DiscoveryPath:  m.options.DiscoveryPath,
+				FetchBurst:     m.options.JWKsFetchBurst,
+				FetchInterval:  m.options.JWKsFetchInterval,
+				MinJWKsTTL:     m.options.MinJWKsCacheTTL,
+				MaxJWKsTTL:     m.options.MaxJWKsCacheTTL,
+			})
+			if err == nil && m.options.JWKsURL == "" {
+				// a tampered discovery must not redirect the key lookup to a host outside of the trusted domains
+				err = m.verifyJWKsURL(issURI, set.ProviderJSON.JWKsURL)
+			}
+			m.options.MetricsRecorder.ObserveDiscoveryDuration(time.Since(start))
+			if err != nil {
+				m.options.MetricsRecorder.IncDiscovery(OutcomeFailure)
+			} else {
+				m.options.MetricsRecorder.IncDiscovery(OutcomeSuccess)
+				set.Clock = m.options.Clock
+			}
 			return set, err
 		})
+		var result singleflight.Result
+		select {
+		case result = <-resultCh:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("token is unverifiable: unable to perform oidc discovery: %w", ctx.Err())
+		}
 
-		if err != nil {
-			return nil, fmt.Errorf("token is unverifiable: unable to perform oidc discovery: %v", err)
+		if result.Err != nil {
+			m.options.Logger.Error("oidc discovery failed", "issuer", issuer, "error", result.Err)
+			// a canceled or timed out discovery says nothing about the issuer
+			if !errors.Is(result.Err, context.Canceled) && !errors.Is(result.Err, context.DeadlineExceeded) && generation == m.generations.of(issuer) {
+				m.failedDiscoveries.set(issuer, result.Err, m.options.Clock().Add(m.options.DiscoveryFailureCooldown))
+			}
+			return nil, fmt.Errorf("token is unverifiable: unable to perform oidc discovery: %w", result.Err)
+		}
+		m.failedDiscoveries.delete(issuer)
+		oidcTenant = result.Val.(*oidcclient.OIDCTenant)
+		m.options.Logger.Debug("oidc discovery performed", "issuer", issuer, "jwks_uri", oidcTenant.(*oidcclient.OIDCTenant).ProviderJSON.JWKsURL)
+		// cached by the issuer with SAP domain, as the discovered issuer differs for custom domains and would never be found.
+		// Results of discoveries which started before an invalidation are returned, but not cached.
+		if generation == m.generations.of(issuer) {
+			m.oidcTenants.set(issuer, oidcTenant, m.options.Clock().Add(cacheExpiration))
+			if generation != m.generations.of(issuer) {
+				// the invalidation raced with the set, its flush might have happened before
+				m.oidcTenants.delete(issuer)
+			}
 		}
-		oidcTenant = newKeySet.(*oidcclient.OIDCTenant)
-		m.oidcTenants.SetDefault(oidcTenant.(*oidcclient.OIDCTenant).ProviderJSON.Issuer, oidcTenant)
 	}
 	return oidcTenant.(*oidcclient.OIDCTenant), nil
 }
@@ -128,20 +619,71 @@ func (m *Middleware) getOIDCTenant(issuer, customIssuer string) (*oidcclient.OID
 func (m *Middleware) verifyIssuer(issuer string) (issURI *url.URL, err error) {
 	issURI, err = url.Parse(issuer)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse issuer URI: %s", issuer)
+		return nil, fmt.Errorf("%w: unable to parse issuer URI: %s", ErrUntrustedIssuer, issuer)
 	}
 
-	if !matchesDomain(issURI.Host, m.identity.GetDomains()) {
-		return nil, fmt.Errorf("token is unverifiable: unknown server (domain doesn't match)")
+	for _, identity := range m.identities() {
+		if matchesDomain(issURI.Host, identity.GetDomains()) {
+			return issURI, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: token is unverifiable: unknown server (domain doesn't match any configured identity)", ErrUntrustedIssuer)
+}
+
+// verifyJWKsURL returns ErrUntrustedJWKsURL unless the host of the discovered jwks_uri is a domain, or a subdomain of a domain, of an identity which trusts the issuer
+func (m *Middleware) verifyJWKsURL(issURI *url.URL, jwksURL string) error {
+	return m.verifyDiscoveredURL(issURI, jwksURL, ErrUntrustedJWKsURL)
+}
+
+// verifyEndpointURL returns ErrUntrustedEndpoint unless the host of the discovered endpoint is a domain, or a subdomain of a domain, of an identity which trusts the issuer
+func (m *Middleware) verifyEndpointURL(issuer, endpointURL string) error {
+	issURI, err := url.Parse(issuer)
+	if err != nil {
+		return fmt.Errorf("%w: unable to parse issuer URI: %s", ErrUntrustedEndpoint, issuer)
 	}
-	return issURI, nil
+	return m.verifyDiscoveredURL(issURI, endpointURL, ErrUntrustedEndpoint)
 }
 
+// verifyDiscoveredURL returns errUntrusted unless the host of the discovered URL is in the domains of an identity which trusts the issuer
+func (m *Middleware) verifyDiscoveredURL(issURI *url.URL, discoveredURL string, errUntrusted error) error {
+	discoveredURI, err := url.Parse(discoveredURL)
+	if err != nil {
+		return fmt.Errorf("%w: unable to parse %s", errUntrusted, discoveredURL)
+	}
+	for _, identity := range m.identities() {
+		if matchesDomain(issURI.Host, identity.GetDomains()) && matchesDomain(discoveredURI.Host, identity.GetDomains()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errUntrusted, discoveredURI.Host)
+}
+
+// trustedDomain returns the first domain of the identities which matches the issuer, or empty string if none matches
+func (m *Middleware) trustedDomain(issuer string) string {
+	issURI, err := url.Parse(issuer)
+	if err != nil {
+		return ""
+	}
+	for _, identity := range m.identities() {
+		if domain, ok := matchingDomain(issURI.Host, identity.GetDomains()); ok {
+			return domain
+		}
+	}
+	return ""
+}
+
+// matchesDomain returns true if hostname is one of the domains or a subdomain of it
 func matchesDomain(hostname string, domains []string) bool {
+	_, ok := matchingDomain(hostname, domains)
+	return ok
+}
+
+// matchingDomain returns the first of the domains which is hostname or a parent domain of it
+func matchingDomain(hostname string, domains []string) (string, bool) {
 	for _, domain := range domains {
-		if strings.HasSuffix(hostname, domain) {
-			return true
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return domain, true
 		}
 	}
-	return false
+	return "", false
 }
@@ -5,12 +5,35 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
 	"github.com/sap/cloud-security-client-go/env"
 	"github.com/sap/cloud-security-client-go/mocks"
+	"github.com/sap/cloud-security-client-go/oidcclient"
 )
 
 func TestAdditionalDomain(t *testing.T) {
@@ -32,12 +55,534 @@ func TestAdditionalDomain(t *testing.T) {
 		t.Errorf("unable to sign provided test token: %v", err)
 	}
 
-	_, err = m.parseAndValidateJWT(rawToken)
+	_, err = m.parseAndValidateJWT(context.Background(), rawToken)
 	if err != nil {
 		t.Error("unexpected error: ", err.Error())
 	}
 }
 
+func TestSingleDomain(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(env.DefaultIdentity{
+		ClientID: oidcMockServer.Config.ClientID,
+		URL:      oidcMockServer.Config.URL,
+		Domain:   oidcMockServer.Config.Domains[0],
+	}, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	if _, err = m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+		t.Errorf("parseAndValidateJWT() unexpected error = %v", err)
+	}
+}
+
+func TestParseAndValidateJWT_errors(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Errorf("error creating test setup: %v", err)
+	}
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	tests := []struct {
+		name    string
+		header  map[string]interface{}
+		claims  mocks.OIDCClaims
+		wantErr error
+	}{
+		{
+			name:   "expired",
+			header: oidcMockServer.DefaultHeaders(),
+			claims: mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				ExpiresAt(time.Now().Add(-2 * time.Minute)).
+				Build(),
+			wantErr: ErrTokenExpired,
+		}, {
+			name:   "not yet valid",
+			header: oidcMockServer.DefaultHeaders(),
+			claims: mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				NotBefore(time.Now().Add(5 * time.Minute)).
+				Build(),
+			wantErr: ErrTokenNotYetValid,
+		}, {
+			name:   "untrusted issuer",
+			header: oidcMockServer.DefaultHeaders(),
+			claims: mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				Issuer("https://another.oidc-server.com/").
+				Build(),
+			wantErr: ErrUntrustedIssuer,
+		}, {
+			name: "missing alg",
+			header: mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).
+				Alg("").
+				Build(),
+			claims:  oidcMockServer.DefaultClaims(),
+			wantErr: ErrMissingAlg,
+		}, {
+			name: "unknown kid",
+			header: mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).
+				KeyID("wrongKey").
+				Build(),
+			claims:  oidcMockServer.DefaultClaims(),
+			wantErr: ErrKeyNotFound,
+		}, {
+			name: "disallowed alg",
+			header: mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).
+				Alg(jwa.HS256).
+				Build(),
+			claims:  oidcMockServer.DefaultClaims(),
+			wantErr: ErrDisallowedAlg,
+		}, {
+			name: "none alg",
+			header: mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).
+				Alg(jwa.NoSignature).
+				Build(),
+			claims:  oidcMockServer.DefaultClaims(),
+			wantErr: ErrDisallowedAlg,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rawToken, err := oidcMockServer.SignToken(tt.claims, tt.header)
+			if err != nil {
+				t.Errorf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_disallowedAlgWithoutDiscovery(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:        oidcMockServer.Server.Client(),
+		AllowedAlgorithms: []jwa.SignatureAlgorithm{jwa.RS256},
+	})
+
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.PS256, jwa.HS256, ""} {
+		rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(),
+			mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).Alg(alg).Build())
+		if err != nil {
+			t.Fatalf("unable to sign provided test token: %v", err)
+		}
+		oidcMockServer.ClearAllHitCounters()
+
+		if _, err = m.parseAndValidateJWT(context.Background(), rawToken); !errors.Is(err, ErrDisallowedAlg) && !errors.Is(err, ErrMissingAlg) {
+			t.Errorf("parseAndValidateJWT() with alg %q error = %v, want %v", alg, err, ErrDisallowedAlg)
+		}
+		if oidcMockServer.WellKnownHitCounter != 0 || oidcMockServer.JWKsHitCounter != 0 {
+			t.Errorf("no discovery and jwks request should be made for alg %q", alg)
+		}
+	}
+}
+
+func TestParseAndValidateJWT_notBeforeWithinSkew(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		NotBefore(time.Now().Add(30*time.Second)).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	if _, err = m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+		t.Errorf("parseAndValidateJWT() unexpected error = %v", err)
+	}
+}
+
+func TestParseAndValidateJWT_clock(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	issuedAt := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		IssuedAt(issuedAt.Add(-10*time.Minute)).
+		NotBefore(issuedAt).
+		ExpiresAt(issuedAt.Add(time.Hour)).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid", now: issuedAt.Add(30 * time.Minute)},
+		{name: "expired within skew", now: issuedAt.Add(time.Hour + 30*time.Second)},
+		{name: "expired", now: issuedAt.Add(time.Hour + 2*time.Minute), wantErr: ErrTokenExpired},
+		{name: "not yet valid within skew", now: issuedAt.Add(-30 * time.Second)},
+		{name: "not yet valid", now: issuedAt.Add(-2 * time.Minute), wantErr: ErrTokenNotYetValid},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient: oidcMockServer.Server.Client(),
+				Clock:      func() time.Time { return tt.now },
+			})
+			_, err := m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_clockSkew(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		IssuedAt(now.Add(-time.Hour)).
+		NotBefore(now.Add(-time.Hour)).
+		ExpiresAt(now.Add(-30*time.Second)).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		clockSkew time.Duration
+		wantErr   error
+	}{
+		{name: "default skew of 1 minute", clockSkew: 0},
+		{name: "skew of 1 minute", clockSkew: time.Minute},
+		{name: "skew of 10 seconds", clockSkew: 10 * time.Second, wantErr: ErrTokenExpired},
+		{name: "no skew", clockSkew: -1, wantErr: ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient: oidcMockServer.Server.Client(),
+				Clock:      func() time.Time { return now },
+				ClockSkew:  tt.clockSkew,
+			})
+			token, err := m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && token.IsExpired() {
+				t.Errorf("IsExpired() expected to respect the clock skew of the middleware")
+			}
+		})
+	}
+}
+
+func TestValidateClaims_leewayInSyncWithIsExpired(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	exp := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		IssuedAt(exp.Add(-time.Hour)).
+		NotBefore(exp.Add(-time.Hour)).
+		ExpiresAt(exp).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	for _, clockSkew := range []time.Duration{0, 10 * time.Second, -1} {
+		for _, offset := range []time.Duration{-time.Second, 0, 500 * time.Millisecond, time.Second, 9 * time.Second, 10 * time.Second, 59 * time.Second, time.Minute, 61 * time.Second} {
+			now := exp.Add(offset)
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient: oidcMockServer.Server.Client(),
+				Clock:      func() time.Time { return now },
+				ClockSkew:  clockSkew,
+			})
+			token, err := ParseUnverified(rawToken)
+			if err != nil {
+				t.Fatalf("ParseUnverified() unexpected error = %v", err)
+			}
+			m.bindToken(&token)
+
+			jwxErr := jwt.Validate(token.getJwtToken(), jwt.WithClock(jwt.ClockFunc(m.options.Clock)), jwt.WithAcceptableSkew(m.options.ClockSkew))
+			if jwxExpired := errors.Is(jwxErr, jwt.ErrTokenExpired()); jwxExpired != token.IsExpired() {
+				t.Errorf("skew %v, offset %v: jwt.Validate() expired = %v, but IsExpired() = %v", clockSkew, offset, jwxExpired, token.IsExpired())
+			}
+			if claimsExpired := errors.Is(m.validateClaims(context.Background(), token, nil), ErrTokenExpired); claimsExpired != token.IsExpired() {
+				t.Errorf("skew %v, offset %v: validateClaims() expired = %v, but IsExpired() = %v", clockSkew, offset, claimsExpired, token.IsExpired())
+			}
+		}
+	}
+}
+
+func TestParseAndValidateJWT_clockTimeUntilExpiry(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		IssuedAt(now).
+		NotBefore(now).
+		ExpiresAt(now.Add(time.Hour)).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+		Clock:      func() time.Time { return now },
+	})
+
+	token, err := m.parseAndValidateJWT(context.Background(), rawToken)
+	if err != nil {
+		t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+	}
+	if got := token.TimeUntilExpiry(); got != time.Hour {
+		t.Errorf("TimeUntilExpiry() got = %v, want %v", got, time.Hour)
+	}
+	now = now.Add(2 * time.Hour)
+	if got := token.TimeUntilExpiry(); got != -time.Hour {
+		t.Errorf("TimeUntilExpiry() of expired token got = %v, want %v", got, -time.Hour)
+	}
+}
+
+func TestParseAndValidateJWT_acceptedAudiences(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:        oidcMockServer.Server.Client(),
+		AcceptedAudiences: []string{"secondaryClient"},
+	})
+
+	tests := []struct {
+		name      string
+		audiences []string
+		wantErr   error
+	}{
+		{name: "client id", audiences: []string{oidcMockServer.Config.ClientID}},
+		{name: "secondary trusted client id", audiences: []string{"notMyClient", "secondaryClient"}},
+		{name: "untrusted audiences", audiences: []string{"notMyClient", "neitherThisOne"}, wantErr: ErrInvalidAudience},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				Audience(tt.audiences...).
+				Build(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsAcceptedAudience_sets(t *testing.T) {
+	m := &Middleware{options: Options{AcceptedAudiences: []string{"api-a", "api-b"}}}
+	clientIDs := []string{"clientid"}
+
+	tests := []struct {
+		name      string
+		audiences []string
+		want      bool
+	}{
+		{name: "single client id", audiences: []string{"clientid"}, want: true},
+		{name: "overlapping with client id", audiences: []string{"other", "clientid"}, want: true},
+		{name: "overlapping with accepted audiences", audiences: []string{"other", "api-b", "api-c"}, want: true},
+		{name: "disjoint", audiences: []string{"other", "api-c"}, want: false},
+		{name: "empty", audiences: nil, want: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.isAcceptedAudience(tt.audiences, clientIDs); got != tt.want {
+				t.Errorf("isAcceptedAudience() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_maxAuthAge(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+		MaxAuthAge: 5 * time.Minute,
+	})
+
+	tests := []struct {
+		name    string
+		claims  *mocks.OIDCClaimsBuilder
+		wantErr error
+	}{
+		{name: "fresh auth_time", claims: mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).AuthTime(time.Now().Add(-time.Minute))},
+		{name: "stale auth_time", claims: mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).AuthTime(time.Now().Add(-time.Hour)), wantErr: ErrAuthTooOld},
+		{name: "missing auth_time", claims: mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()), wantErr: ErrAuthTooOld},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rawToken, err := oidcMockServer.SignToken(tt.claims.Build(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_requiredAMR(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:  oidcMockServer.Server.Client(),
+		RequiredAMR: []string{"mfa"},
+	})
+
+	tests := []struct {
+		name    string
+		amr     []string
+		wantErr error
+	}{
+		{name: "multi-factor authentication", amr: []string{"pwd", "mfa"}},
+		{name: "password only", amr: []string{"pwd"}, wantErr: ErrMissingAMR},
+		{name: "no amr", wantErr: ErrMissingAMR},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				AMR(tt.amr...).
+				Build(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_skipAudienceValidation(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		Audience("unrelatedApp").
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		m := NewMiddleware(oidcMockServer.Config, Options{
+			HTTPClient:             oidcMockServer.Server.Client(),
+			SkipAudienceValidation: skip,
+		})
+		_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+		if skip && err != nil {
+			t.Errorf("parseAndValidateJWT() with SkipAudienceValidation unexpected error = %v", err)
+		}
+		if !skip && !errors.Is(err, ErrInvalidAudience) {
+			t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrInvalidAudience)
+		}
+	}
+}
+
+func TestParseAndValidateJWT_verifyAzp(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:        oidcMockServer.Server.Client(),
+		AcceptedAudiences: []string{"secondaryClient"},
+		VerifyAzp:         true,
+	})
+	clientID := oidcMockServer.Config.ClientID
+
+	tests := []struct {
+		name      string
+		audiences []string
+		azp       string
+		wantErr   error
+	}{
+		{name: "single audience ignores azp", audiences: []string{clientID}, azp: "otherClient"},
+		{name: "single accepted audience ignores missing azp", audiences: []string{"secondaryClient"}},
+		{name: "multiple audiences with matching azp", audiences: []string{"otherClient", clientID}, azp: clientID},
+		{name: "multiple audiences with mismatching azp", audiences: []string{"otherClient", clientID}, azp: "otherClient", wantErr: ErrAzpMismatch},
+		{name: "multiple audiences without azp", audiences: []string{"otherClient", clientID}, wantErr: ErrAzpMismatch},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			additionalClaims := map[string]interface{}{}
+			if tt.azp != "" {
+				additionalClaims["azp"] = tt.azp
+			}
+			rawToken, err := oidcMockServer.SignTokenWithAdditionalClaims(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				Audience(tt.audiences...).
+				Build(), additionalClaims, oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestAuthMiddleware_getOIDCTenant(t *testing.T) {
 	oidcMockServer, err := mocks.NewOIDCMockServer()
 	if err != nil {
@@ -57,7 +602,7 @@ func TestAuthMiddleware_getOIDCTenant(t *testing.T) {
 		t.Errorf("unable to sign provided test token: %v", err)
 	}
 
-	token, err := m.parseAndValidateJWT(rawToken)
+	token, err := m.parseAndValidateJWT(context.Background(), rawToken)
 	if err != nil {
 		t.Errorf("unable to parse provided test token: %v", err)
 	}
@@ -70,7 +615,7 @@ func TestAuthMiddleware_getOIDCTenant(t *testing.T) {
 		go func(i int) {
 			defer wg.Done()
 
-			set, err := m.getOIDCTenant(token.Issuer(), token.CustomIssuer())
+			set, err := m.getOIDCTenant(context.Background(), token.Issuer(), token.CustomIssuer())
 			if err != nil || set == nil {
 				t.Errorf("unexpected error on getOIDCTenant(), %v", err)
 			}
@@ -89,16 +634,1256 @@ func TestAuthMiddleware_getOIDCTenant(t *testing.T) {
 	}
 }
 
-func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		wg.Wait()
-	}()
-	select {
-	case <-c:
-		return false // completed normally
-	case <-time.After(timeout):
-		return true // timed out
+func TestAuthMiddleware_getOIDCTenant_maxTenants(t *testing.T) {
+	var servers []*mocks.MockServer
+	var domains []string
+	for i := 0; i < 3; i++ {
+		oidcMockServer, err := mocks.NewOIDCMockServer()
+		if err != nil {
+			t.Fatalf("error creating test setup: %v", err)
+		}
+		defer oidcMockServer.Server.Close()
+		servers = append(servers, oidcMockServer)
+		domains = append(domains, oidcMockServer.Config.Domains...)
+	}
+	m := NewMiddleware(env.DefaultIdentity{
+		ClientID: servers[0].Config.ClientID,
+		URL:      servers[0].Config.URL,
+		Domains:  domains,
+	}, Options{
+		HTTPClient: servers[0].Server.Client(), // all httptest servers present the same certificate
+		MaxTenants: 2,
+	})
+
+	for _, server := range servers {
+		if _, err := m.getOIDCTenant(context.Background(), server.Server.URL, ""); err != nil {
+			t.Fatalf("getOIDCTenant() unexpected error = %v", err)
+		}
+	}
+
+	if got := m.oidcTenants.len(); got != 2 {
+		t.Errorf("expected tenant cache to be bounded; got = %d tenants, want: 2", got)
+	}
+	if _, _, found := m.oidcTenants.get(servers[0].Server.URL); found {
+		t.Errorf("expected least recently used tenant %s to be evicted", servers[0].Server.URL)
+	}
+	if _, err := m.getOIDCTenant(context.Background(), servers[0].Server.URL, ""); err != nil {
+		t.Fatalf("getOIDCTenant() unexpected error = %v", err)
+	}
+	if hits := servers[0].WellKnownHitCounter; hits != 2 {
+		t.Errorf("expected discovery of evicted tenant to be performed again; got = %d, want: 2", hits)
+	}
+	if hits := servers[2].WellKnownHitCounter; hits != 1 {
+		t.Errorf("expected recently used tenant to stay cached; got = %d discoveries, want: 1", hits)
+	}
+}
+
+func TestAuthMiddleware_getOIDCTenant_jwksURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwksURL func(serverURL string) string
+		wantErr error
+	}{
+		{name: "jwks_uri of the trusted domain", jwksURL: func(serverURL string) string { return serverURL + "/oauth2/certs" }},
+		{name: "cross-domain jwks_uri", jwksURL: func(string) string { return "https://attacker.example.com/oauth2/certs" }, wantErr: ErrUntrustedJWKsURL},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var server *httptest.Server
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"issuer":"` + server.URL + `","jwks_uri":"` + tt.jwksURL(server.URL) + `"}`))
+			}))
+			defer server.Close()
+			serverURL, _ := url.Parse(server.URL)
+			m := NewMiddleware(env.DefaultIdentity{
+				ClientID: "clientid",
+				Domains:  []string{serverURL.Host},
+			}, Options{HTTPClient: server.Client(), DiscoveryRetries: -1})
+			defer m.Close()
+
+			_, err := m.getOIDCTenant(context.Background(), server.URL, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("getOIDCTenant() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyJWKsURL(t *testing.T) {
+	m := NewMiddleware(env.DefaultIdentity{
+		ClientID: "clientid",
+		Domains:  []string{"accounts.ondemand.com"},
+	}, Options{})
+	defer m.Close()
+	issURI, _ := url.Parse("https://tenant.accounts.ondemand.com")
+
+	tests := []struct {
+		jwksURL string
+		wantErr bool
+	}{
+		{jwksURL: "https://tenant.accounts.ondemand.com/oauth2/certs"},
+		{jwksURL: "https://keys.accounts.ondemand.com/oauth2/certs"},
+		{jwksURL: "https://evilaccounts.ondemand.com/oauth2/certs", wantErr: true},
+		{jwksURL: "https://accounts.ondemand.com.example.com/oauth2/certs", wantErr: true},
+		{jwksURL: "https://example.com/?cb=accounts.ondemand.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.jwksURL, func(t *testing.T) {
+			err := m.verifyJWKsURL(issURI, tt.jwksURL)
+			if tt.wantErr != errors.Is(err, ErrUntrustedJWKsURL) {
+				t.Errorf("verifyJWKsURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware_getOIDCTenant_failedDiscovery(t *testing.T) {
+	var unavailable int32 = 1
+	discoveryHitCounter := 0
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		discoveryHitCounter++
+		if atomic.LoadInt32(&unavailable) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"issuer":"` + server.URL + `","jwks_uri":"` + server.URL + `/oauth2/certs"}`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	now := time.Now()
+	m := NewMiddleware(env.DefaultIdentity{
+		ClientID: "clientid",
+		Domains:  []string{serverURL.Host},
+	}, Options{
+		HTTPClient:               server.Client(),
+		Clock:                    func() time.Time { return now },
+		DiscoveryFailureCooldown: time.Minute,
+		DiscoveryRetries:         -1,
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := m.getOIDCTenant(context.Background(), server.URL, ""); err == nil {
+			t.Fatalf("getOIDCTenant() expected error for unavailable discovery endpoint")
+		}
+	}
+	if discoveryHitCounter != 1 {
+		t.Errorf("expected repeated failures to fail fast; got = %d discoveries, want: 1", discoveryHitCounter)
+	}
+
+	atomic.StoreInt32(&unavailable, 0)
+	now = now.Add(2 * time.Minute)
+	tenant, err := m.getOIDCTenant(context.Background(), server.URL, "")
+	if err != nil {
+		t.Fatalf("getOIDCTenant() expected to recover after cooldown, got error = %v", err)
+	}
+	if tenant.ProviderJSON.Issuer != server.URL {
+		t.Errorf("getOIDCTenant() issuer got = %s, want %s", tenant.ProviderJSON.Issuer, server.URL)
+	}
+	if discoveryHitCounter != 2 {
+		t.Errorf("expected discovery to be retried after cooldown; got = %d discoveries, want: 2", discoveryHitCounter)
+	}
+}
+
+func TestParseAndValidateJWT_jwksFetchRateLimit(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:        oidcMockServer.Server.Client(),
+		JWKsFetchBurst:    3,
+		JWKsFetchInterval: time.Hour,
+	})
+
+	rateLimited := 0
+	for i := 0; i < 20; i++ {
+		rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+			ZoneID(uuid.New().String()).
+			Build(), oidcMockServer.DefaultHeaders())
+		if err != nil {
+			t.Fatalf("unable to sign provided test token: %v", err)
+		}
+		if _, err = m.parseAndValidateJWT(context.Background(), rawToken); errors.Is(err, oidcclient.ErrRateLimited) {
+			rateLimited++
+		} else if err != nil {
+			t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+		}
+	}
+	if hits := oidcMockServer.JWKsHitCounter; hits != 3 {
+		t.Errorf("expected jwks fetches to be rate limited; got = %d fetches, want: 3", hits)
+	}
+	if rateLimited != 17 {
+		t.Errorf("expected tokens of further zones to fail fast; got = %d, want: 17", rateLimited)
+	}
+}
+
+func TestParseAndValidateJWT_keyFunc(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	fixedKey, err := jwk.New(&oidcMockServer.RSAKey.PublicKey)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	otherJWK, _ := jwk.New(&otherKey.PublicKey)
+
+	tests := []struct {
+		name    string
+		keyFunc KeyFunc
+		issuer  string
+		wantErr error
+	}{
+		{
+			name:    "fixed key",
+			keyFunc: func(context.Context, Token) (jwk.Key, error) { return fixedKey, nil },
+		}, {
+			name:    "other key",
+			keyFunc: func(context.Context, Token) (jwk.Key, error) { return otherJWK, nil },
+			wantErr: ErrInvalidSignature,
+		}, {
+			name:    "resolution failed",
+			keyFunc: func(context.Context, Token) (jwk.Key, error) { return nil, errors.New("hsm unavailable") },
+			wantErr: ErrKeyNotFound,
+		}, {
+			name:    "untrusted issuer",
+			keyFunc: func(context.Context, Token) (jwk.Key, error) { return fixedKey, nil },
+			issuer:  "https://untrusted.example.com",
+			wantErr: ErrUntrustedIssuer,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			oidcMockServer.ClearAllHitCounters()
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient: oidcMockServer.Server.Client(),
+				KeyFunc:    tt.keyFunc,
+			})
+			claims := mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims())
+			if tt.issuer != "" {
+				claims.Issuer(tt.issuer)
+			}
+			rawToken, err := oidcMockServer.SignToken(claims.Build(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+			if oidcMockServer.WellKnownHitCounter != 0 || oidcMockServer.JWKsHitCounter != 0 {
+				t.Errorf("expected no discovery or jwks request with KeyFunc")
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_additionalIdentities(t *testing.T) {
+	var servers []*mocks.MockServer
+	for i := 0; i < 3; i++ {
+		oidcMockServer, err := mocks.NewOIDCMockServer()
+		if err != nil {
+			t.Fatalf("error creating test setup: %v", err)
+		}
+		defer oidcMockServer.Server.Close()
+		oidcMockServer.Config.ClientID = fmt.Sprintf("clientid-%d", i)
+		servers = append(servers, oidcMockServer)
+	}
+	m := NewMiddleware(servers[0].Config, Options{
+		HTTPClient:           servers[0].Server.Client(), // all httptest servers present the same certificate
+		AdditionalIdentities: []env.Identity{servers[1].Config},
+	})
+
+	tests := []struct {
+		name     string
+		server   *mocks.MockServer
+		audience string
+		wantErr  error
+	}{
+		{name: "token of identity", server: servers[0]},
+		{name: "token of additional identity", server: servers[1]},
+		{name: "token of additional identity for other client", server: servers[1], audience: servers[0].Config.ClientID, wantErr: ErrInvalidAudience},
+		{name: "token of unknown tenant", server: servers[2], wantErr: ErrUntrustedIssuer},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			claims := mocks.NewOIDCClaimsBuilder(tt.server.DefaultClaims())
+			if tt.audience != "" {
+				claims.Audience(tt.audience)
+			}
+			rawToken, err := tt.server.SignToken(claims.Build(), tt.server.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_consumerTenant(t *testing.T) {
+	const providerTenant = "11111111-2222-3333-4444-888888888888"
+	const subscribedTenant = "aaaaaaaa-bbbb-cccc-dddd-000000000001"
+	provider, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer provider.Server.Close()
+	consumer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer consumer.Server.Close()
+	// the consumer tenant shares the domain of the provider tenant, e.g. accounts.ondemand.com
+	provider.Config.Domains = append(provider.Config.Domains, consumer.Config.Domains...)
+	provider.Config.ZoneUUID = uuid.MustParse(providerTenant)
+	m := NewMiddleware(provider.Config, Options{
+		HTTPClient:   provider.Server.Client(), // all httptest servers present the same certificate
+		IsSubscribed: func(tenantID string) bool { return tenantID == subscribedTenant },
+	})
+
+	tests := []struct {
+		name     string
+		issuer   *mocks.MockServer
+		tenantID string
+		audience string
+		wantErr  error
+	}{
+		{name: "provider tenant", issuer: provider, tenantID: providerTenant},
+		{name: "subscribed consumer tenant", issuer: consumer, tenantID: subscribedTenant},
+		{name: "unsubscribed consumer tenant", issuer: consumer, tenantID: "aaaaaaaa-bbbb-cccc-dddd-000000000002", wantErr: ErrNotSubscribed},
+		{name: "subscribed consumer tenant for other client", issuer: consumer, tenantID: subscribedTenant, audience: "other-client", wantErr: ErrInvalidAudience},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			audience := tt.audience
+			if audience == "" {
+				audience = provider.Config.ClientID
+			}
+			rawToken, err := tt.issuer.SignToken(mocks.NewOIDCClaimsBuilder(tt.issuer.DefaultClaims()).
+				Audience(audience).
+				AppTID(tt.tenantID).
+				Build(), tt.issuer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_iasIssuer(t *testing.T) {
+	const customIssuer = "https://custom.oidc-server.com"
+	oidcMockServer, err := mocks.NewOIDCMockServerWithCustomIssuer(customIssuer)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	tests := []struct {
+		name    string
+		iss     string
+		iasIss  string
+		wantErr error
+	}{
+		{name: "proxied token", iss: customIssuer, iasIss: oidcMockServer.Server.URL},
+		{name: "iss does not match discovered issuer", iss: "https://another.oidc-server.com", iasIss: oidcMockServer.Server.URL, wantErr: ErrUntrustedIssuer},
+		{name: "ias_iss with untrusted domain", iss: oidcMockServer.Server.URL, iasIss: "https://untrusted.oidc-server.com", wantErr: ErrUntrustedIssuer},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+				Issuer(tt.iss).
+				IasIssuer(tt.iasIss).
+				Build(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_iasIssuerCached(t *testing.T) {
+	const customIssuer = "https://custom.oidc-server.com"
+	oidcMockServer, err := mocks.NewOIDCMockServerWithCustomIssuer(customIssuer)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		Issuer(customIssuer).
+		IasIssuer(oidcMockServer.Server.URL).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err = m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+			t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+		}
+	}
+	if hits := oidcMockServer.WellKnownHitCounter; hits != 1 {
+		t.Errorf("expected discovery of proxied token to be cached; got = %d discoveries, want: 1", hits)
+	}
+}
+
+func TestParseAndValidateJWT_invalidSignature(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Errorf("error creating test setup: %v", err)
+	}
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Errorf("unable to sign provided test token: %v", err)
+	}
+	otherToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).Subject("other").Build(),
+		oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Errorf("unable to sign provided test token: %v", err)
+	}
+	tamperedToken := rawToken[:strings.LastIndexByte(rawToken, '.')] + otherToken[strings.LastIndexByte(otherToken, '.'):]
+
+	_, err = m.parseAndValidateJWT(context.Background(), tamperedToken)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestParseAndValidateJWT_algorithms(t *testing.T) {
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.RS256, jwa.ES256, jwa.ES384, jwa.ES512, jwa.PS256, jwa.PS384, jwa.PS512} {
+		alg := alg
+		t.Run(alg.String(), func(t *testing.T) {
+			oidcMockServer, err := mocks.NewOIDCMockServerWithSigningAlg(alg)
+			if err != nil {
+				t.Fatalf("error creating test setup: %v", err)
+			}
+			defer oidcMockServer.Server.Close()
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient: oidcMockServer.Server.Client(),
+			})
+
+			rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			if _, err = m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+				t.Errorf("parseAndValidateJWT() unexpected error = %v", err)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_verifiedWithKeyID(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "kid of header",
+			header: oidcMockServer.DefaultHeaders(),
+			want:   "testKey",
+		}, {
+			name:   "no kid in header",
+			header: mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).KeyID("").Build(),
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), tt.header)
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+			token, err := m.parseAndValidateJWT(context.Background(), rawToken)
+			if err != nil {
+				t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+			}
+			if got := token.VerifiedWithKeyID(); got != tt.want {
+				t.Errorf("VerifiedWithKeyID() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_verifiedIssuerAndDomain(t *testing.T) {
+	const customIssuer = "https://custom.oidc-server.com"
+	oidcMockServer, err := mocks.NewOIDCMockServerWithCustomIssuer(customIssuer)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	serverDomain := oidcMockServer.Config.Domains[0]
+	oidcMockServer.Config.Domains = []string{"accounts.example.org", serverDomain}
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		Issuer(customIssuer).
+		IasIssuer(oidcMockServer.Server.URL).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	token, err := m.parseAndValidateJWT(context.Background(), rawToken)
+	if err != nil {
+		t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+	}
+	if got := token.VerifiedIssuer(); got != oidcMockServer.Server.URL {
+		t.Errorf("VerifiedIssuer() got = %q, want the SAP issuer %q", got, oidcMockServer.Server.URL)
+	}
+	if got := token.VerifiedDomain(); got != serverDomain {
+		t.Errorf("VerifiedDomain() got = %q, want %q", got, serverDomain)
+	}
+	unverified, _ := ParseUnverified(rawToken)
+	if unverified.VerifiedIssuer() != "" || unverified.VerifiedDomain() != "" {
+		t.Errorf("expected no verified issuer and domain for unverified token")
+	}
+}
+
+func TestParseAndValidateJWT_minRSAKeyBits(t *testing.T) {
+	tests := []struct {
+		name          string
+		keyBits       int
+		minRSAKeyBits int
+		wantErr       error
+	}{
+		{name: "1024 bit key rejected by default", keyBits: 1024, wantErr: ErrWeakKey},
+		{name: "2048 bit key accepted by default", keyBits: 2048},
+		{name: "2048 bit key rejected by custom minimum", keyBits: 2048, minRSAKeyBits: 3072, wantErr: ErrWeakKey},
+		{name: "1024 bit key accepted by custom minimum", keyBits: 1024, minRSAKeyBits: 1024},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			oidcMockServer, err := mocks.NewOIDCMockServer()
+			if err != nil {
+				t.Fatalf("error creating test setup: %v", err)
+			}
+			defer oidcMockServer.Server.Close()
+			oidcMockServer.RSAKey, err = rsa.GenerateKey(rand.Reader, tt.keyBits)
+			if err != nil {
+				t.Fatalf("error generating rsa key: %v", err)
+			}
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient:    oidcMockServer.Server.Client(),
+				MinRSAKeyBits: tt.minRSAKeyBits,
+			})
+			rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+			if err != nil {
+				t.Fatalf("unable to sign provided test token: %v", err)
+			}
+
+			_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_corruptKey(t *testing.T) {
+	tests := []struct {
+		name string
+		jwk  string
+	}{
+		{name: "empty rsa modulus", jwk: `{"kty":"RSA","kid":"testKey","e":"AQAB","n":""}`},
+		{name: "missing rsa exponent", jwk: `{"kty":"RSA","kid":"testKey","e":"","n":"AJtUGmczI7RHx3Ypqxz9"}`},
+		{name: "ec point not on curve", jwk: `{"kty":"EC","kid":"testKey","crv":"P-256","x":"AQAB","y":"AQAB"}`},
+	}
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			jwksServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"keys":[` + tt.jwk + `]}`))
+			}))
+			defer jwksServer.Close()
+			m := NewMiddleware(oidcMockServer.Config, Options{
+				HTTPClient: oidcMockServer.Server.Client(),
+				JWKsURL:    jwksServer.URL,
+			})
+
+			_, err := m.parseAndValidateJWT(context.Background(), rawToken)
+			if !errors.Is(err, ErrKeyConstruction) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrKeyConstruction)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_malformed(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+	validToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	parts := strings.Split(validToken, ".")
+
+	tests := []struct {
+		name     string
+		rawToken string
+	}{
+		{name: "json serialization without signatures", rawToken: `{"payload":"` + parts[1] + `","signatures":[]}`},
+		{name: "json serialization with empty signature", rawToken: `{"payload":"` + parts[1] + `","signatures":[{}]}`},
+		{name: "flattened json serialization without header", rawToken: `{"payload":"` + parts[1] + `","signature":"` + parts[2] + `"}`},
+		{name: "json serialization with multiple signatures", rawToken: `{"payload":"` + parts[1] + `","signatures":[` +
+			`{"protected":"` + parts[0] + `","signature":"` + parts[2] + `"},{"protected":"` + parts[0] + `","signature":"` + parts[2] + `"}]}`},
+		{name: "missing signature segment", rawToken: parts[0] + "." + parts[1]},
+		{name: "additional segment", rawToken: validToken + "." + parts[2]},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.parseAndValidateJWT(context.Background(), tt.rawToken)
+			if !errors.Is(err, ErrMalformedToken) {
+				t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrMalformedToken)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_edDSA(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServerWithSigningAlg(jwa.EdDSA)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:        oidcMockServer.Server.Client(),
+		AllowedAlgorithms: []jwa.SignatureAlgorithm{jwa.EdDSA},
+	})
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	if _, err = m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+		t.Errorf("parseAndValidateJWT() unexpected error = %v", err)
+	}
+
+	parts := strings.Split(rawToken, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	signature[0] ^= 0xff
+	tamperedToken := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+	if _, err = m.parseAndValidateJWT(context.Background(), tamperedToken); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	defaultMiddleware := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+	if _, err = defaultMiddleware.parseAndValidateJWT(context.Background(), rawToken); !errors.Is(err, ErrDisallowedAlg) {
+		t.Errorf("parseAndValidateJWT() with default algorithms error = %v, want %v", err, ErrDisallowedAlg)
+	}
+}
+
+func TestParseAndValidateJWT_keyTypeMismatch(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+
+	// the token claims ES256, but the jwks only provide an RSA key
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(),
+		mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).Alg(jwa.ES256).Build())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestParseAndValidateJWT_noneAlg(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:        oidcMockServer.Server.Client(),
+		AllowedAlgorithms: []jwa.SignatureAlgorithm{jwa.NoSignature, "NONE", "None"},
+	})
+	signedToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	payload := strings.Split(signedToken, ".")[1]
+
+	for _, alg := range []string{"none", "NONE", "None"} {
+		// unsecured jwt with an empty signature, as an attacker would forge it
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","kid":"testKey"}`))
+		rawToken := header + "." + payload + "."
+		oidcMockServer.ClearAllHitCounters()
+
+		_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+		if !errors.Is(err, ErrDisallowedAlg) {
+			t.Errorf("parseAndValidateJWT() with alg %s error = %v, want %v", alg, err, ErrDisallowedAlg)
+		}
+		if oidcMockServer.JWKsHitCounter != 0 {
+			t.Errorf("no jwks should be fetched for alg %s", alg)
+		}
+	}
+}
+
+func TestParseAndValidateJWT_contextCanceledDuringDiscovery(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Errorf("error creating test setup: %v", err)
+	}
+	release := make(chan struct{})
+	hangingServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hangingServer.Close()
+	defer close(release)
+
+	hangingServerURL, _ := url.Parse(hangingServer.URL)
+	m := NewMiddleware(env.DefaultIdentity{
+		ClientID: oidcMockServer.Config.ClientID,
+		Domains:  []string{hangingServerURL.Host},
+	}, Options{
+		HTTPClient: hangingServer.Client(),
+	})
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		Issuer(hangingServer.URL).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Errorf("unable to sign provided test token: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = m.parseAndValidateJWT(ctx, rawToken)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("parseAndValidateJWT() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("parseAndValidateJWT() did not return promptly after cancellation, took %v", elapsed)
+	}
+}
+
+func TestAuthMiddleware_getOIDCTenant_sharedDiscoveryCanceledByFirstCaller(t *testing.T) {
+	var discoveries int32
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slowServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&discoveries, 1)
+		requested <- struct{}{}
+		<-release
+		_, _ = fmt.Fprintf(w, `{"issuer":"https://%s","jwks_uri":"https://%s/oauth2/certs"}`, r.Host, r.Host)
+	}))
+	defer slowServer.Close()
+	slowServerURL, _ := url.Parse(slowServer.URL)
+	m := NewMiddleware(env.DefaultIdentity{
+		ClientID: "clientid",
+		Domains:  []string{slowServerURL.Host},
+	}, Options{
+		HTTPClient: slowServer.Client(),
+	})
+	defer m.Close()
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := m.getOIDCTenant(firstCtx, slowServer.URL, "")
+		firstErr <- err
+	}()
+	<-requested
+	secondErr := make(chan error, 1)
+	go func() {
+		_, err := m.getOIDCTenant(context.Background(), slowServer.URL, "")
+		secondErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let the second caller join the shared discovery
+
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("getOIDCTenant() of the first caller error = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if err := <-secondErr; err != nil {
+		t.Errorf("getOIDCTenant() of the second caller failed by the cancellation of the first one: %v", err)
+	}
+	if got := atomic.LoadInt32(&discoveries); got != 1 {
+		t.Errorf("discovery should be shared by both callers, got %d discoveries", got)
+	}
+	if _, _, failed := m.failedDiscoveries.get(slowServer.URL); failed {
+		t.Errorf("the cancellation of the first caller must not be cached as failed discovery")
+	}
+}
+
+func TestParseAndValidateJWT_tracing(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Errorf("error creating test setup: %v", err)
+	}
+	spanRecorder := tracetest.NewSpanRecorder()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:     oidcMockServer.Server.Client(),
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)),
+	})
+
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(),
+		mocks.NewOIDCHeaderBuilder(oidcMockServer.DefaultHeaders()).KeyID("wrongKey").Build())
+	if err != nil {
+		t.Errorf("unable to sign provided test token: %v", err)
+	}
+	_, err = m.parseAndValidateJWT(context.Background(), rawToken)
+	if err == nil {
+		t.Errorf("parseAndValidateJWT() expected error")
+	}
+
+	spans := spanRecorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 ended spans, got %d", len(spans))
+	}
+	wantNames := []string{"auth.getOIDCTenant", "auth.verifySignature", "auth.parseAndValidateJWT"}
+	wantStatus := []codes.Code{codes.Unset, codes.Error, codes.Error}
+	for i, span := range spans {
+		if span.Name() != wantNames[i] {
+			t.Errorf("span %d name got = %s, want %s", i, span.Name(), wantNames[i])
+		}
+		if span.Status().Code != wantStatus[i] {
+			t.Errorf("span %s status got = %v, want %v", span.Name(), span.Status().Code, wantStatus[i])
+		}
+	}
+	for _, kv := range spans[1].Attributes() {
+		if kv.Key == "kid" && kv.Value.AsString() != "wrongKey" {
+			t.Errorf("span %s attribute kid got = %s, want wrongKey", spans[1].Name(), kv.Value.AsString())
+		}
+	}
+}
+
+func TestParseAndValidateJWT_tokenCache(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	rawToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		IssuedAt(now).
+		NotBefore(now).
+		ExpiresAt(now.Add(time.Hour)).
+		Build(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		t.Fatalf("unable to sign provided test token: %v", err)
+	}
+	spanRecorder := tracetest.NewSpanRecorder()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:       oidcMockServer.Server.Client(),
+		TracerProvider:   sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)),
+		Clock:            func() time.Time { return now },
+		EnableTokenCache: true,
+	})
+	signatureVerifications := func() int {
+		count := 0
+		for _, span := range spanRecorder.Ended() {
+			if span.Name() == "auth.verifySignature" {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; i < 3; i++ {
+		token, err := m.parseAndValidateJWT(context.Background(), rawToken)
+		if err != nil {
+			t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+		}
+		if token.Email() != "foo@bar.org" {
+			t.Errorf("parseAndValidateJWT() email got = %s, want foo@bar.org", token.Email())
+		}
+	}
+	if got := signatureVerifications(); got != 1 {
+		t.Errorf("expected cached token to skip signature verification; got = %d verifications, want: 1", got)
+	}
+
+	// expired JWKs are fetched again, tokens verified with the previous keys are verified once more
+	now = now.Add(20 * time.Minute)
+	if _, err = m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+		t.Fatalf("parseAndValidateJWT() unexpected error = %v", err)
+	}
+	if got := signatureVerifications(); got != 2 {
+		t.Errorf("expected changed keys to invalidate the cached token; got = %d verifications, want: 2", got)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err = m.parseAndValidateJWT(context.Background(), rawToken); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("parseAndValidateJWT() error = %v, want %v", err, ErrTokenExpired)
+	}
+	if m.tokenCache.len() != 0 {
+		t.Errorf("expected expired token to be removed from cache, got %d cached tokens", m.tokenCache.len())
+	}
+}
+
+func BenchmarkParseAndValidateJWT(b *testing.B) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	if err != nil {
+		b.Fatalf("error creating test setup: %v", err)
+	}
+	defer oidcMockServer.Server.Close()
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient: oidcMockServer.Server.Client(),
+	})
+	rawToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	if err != nil {
+		b.Fatalf("unable to sign provided test token: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.parseAndValidateJWT(context.Background(), rawToken); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestMatchesDomain(t *testing.T) {
+	domains := []string{"accounts.ondemand.com", "my.arbitrary.domain"}
+	tests := []struct {
+		name     string
+		hostname string
+		want     bool
+	}{
+		{
+			name:     "subdomain",
+			hostname: "foo.accounts.ondemand.com",
+			want:     true,
+		}, {
+			name:     "domain itself",
+			hostname: "accounts.ondemand.com",
+			want:     true,
+		}, {
+			name:     "second domain",
+			hostname: "foo.my.arbitrary.domain",
+			want:     true,
+		}, {
+			name:     "suffix without label boundary",
+			hostname: "evilaccounts.ondemand.com",
+			want:     false,
+		}, {
+			name:     "parent domain",
+			hostname: "ondemand.com",
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesDomain(tt.hostname, domains); got != tt.want {
+				t.Errorf("matchesDomain(%s) got = %v, want %v", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		wg.Wait()
+	}()
+	select {
+	case <-c:
+		return false // completed normally
+	case <-time.After(timeout):
+		return true // timed out
+	}
+}
+
+func BenchmarkValidateToken(b *testing.B) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(b)
+	rawToken := oidcMockServer.MustSignToken(b, nil)
+
+	benchmarks := []struct {
+		name    string
+		options Options
+		// prepare runs before each validation outside the measured time
+		prepare func(m *Middleware)
+	}{
+		{
+			name:    "warm cache",
+			options: Options{HTTPClient: oidcMockServer.Server.Client()},
+		},
+		{
+			name:    "cold cache",
+			options: Options{HTTPClient: oidcMockServer.Server.Client()},
+			prepare: func(m *Middleware) { m.ClearCache() },
+		},
+		{
+			name:    "token cache hit",
+			options: Options{HTTPClient: oidcMockServer.Server.Client(), EnableTokenCache: true},
+		},
+	}
+	for _, bm := range benchmarks {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			m := NewMiddleware(oidcMockServer.Config, bm.options)
+			defer m.Close()
+			if _, err := m.ValidateToken(context.Background(), rawToken); err != nil {
+				b.Fatalf("unable to validate token: %v", err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bm.prepare != nil {
+					b.StopTimer()
+					bm.prepare(m)
+					b.StartTimer()
+				}
+				if _, err := m.ValidateToken(context.Background(), rawToken); err != nil {
+					b.Fatalf("unable to validate token: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAndValidateJWT_symmetricKey(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	const internalIssuer = "https://orders.internal"
+	m := NewMiddleware(oidcMockServer.Config, Options{
+		HTTPClient:         oidcMockServer.Server.Client(),
+		AllowedAlgorithms:  []jwa.SignatureAlgorithm{jwa.RS256, jwa.HS256},
+		SymmetricKey:       secret,
+		SymmetricKeyIssuer: internalIssuer,
+	})
+	defer m.Close()
+
+	signHS256 := func(issuer string, key []byte) string {
+		token := jwt.New()
+		_ = token.Set(jwt.IssuerKey, issuer)
+		_ = token.Set(jwt.AudienceKey, []string{oidcMockServer.Config.ClientID})
+		_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+		signed, err := jwt.Sign(token, jwa.HS256, key)
+		if err != nil {
+			t.Fatalf("unable to sign HS256 token: %v", err)
+		}
+		return string(signed)
+	}
+	valid := signHS256(internalIssuer, secret)
+	parts := strings.Split(valid, ".")
+	tamperedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + internalIssuer + `","aud":["` + oidcMockServer.Config.ClientID + `"],"exp":9999999999}`))
+
+	tests := []struct {
+		name     string
+		rawToken string
+		wantErr  error
+	}{
+		{name: "valid HS256 token", rawToken: valid},
+		{name: "tampered payload", rawToken: parts[0] + "." + tamperedPayload + "." + parts[2], wantErr: ErrInvalidSignature},
+		{name: "signed with another secret", rawToken: signHS256(internalIssuer, []byte("fedcba9876543210fedcba9876543210")), wantErr: ErrInvalidSignature},
+		{name: "HS256 token of the IAS issuer", rawToken: signHS256(oidcMockServer.Server.URL, secret), wantErr: ErrUntrustedIssuer},
+		{name: "RS256 token", rawToken: oidcMockServer.MustSignToken(t, nil)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.parseAndValidateJWT(context.Background(), tt.rawToken)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("rejected without SymmetricKey", func(t *testing.T) {
+		withoutKey := NewMiddleware(oidcMockServer.Config, Options{HTTPClient: oidcMockServer.Server.Client()})
+		defer withoutKey.Close()
+		if _, err := withoutKey.parseAndValidateJWT(context.Background(), valid); !errors.Is(err, ErrDisallowedAlg) {
+			t.Errorf("parseAndValidateJWT() error = %v, wantErr %v", err, ErrDisallowedAlg)
+		}
+	})
+	t.Run("issuer of the identity", func(t *testing.T) {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("NewMiddleware() panic = %v, want %v", err, ErrInvalidConfig)
+			}
+		}()
+		NewMiddleware(oidcMockServer.Config, Options{
+			AllowedAlgorithms:  []jwa.SignatureAlgorithm{jwa.HS256},
+			SymmetricKey:       secret,
+			SymmetricKeyIssuer: oidcMockServer.Server.URL,
+		})
+	})
+}
+
+func TestParseAndValidateJWT_algorithmConfusion(t *testing.T) {
+	oidcMockServer := mocks.NewTestOIDCMockServer(t)
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&oidcMockServer.RSAKey.PublicKey)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})
+
+	// the attacker signs a HS256 token of the trusted issuer with the public RSA key as secret
+	signWithPublicKey := func(issuer string) string {
+		token := jwt.New()
+		_ = token.Set(jwt.IssuerKey, issuer)
+		_ = token.Set(jwt.AudienceKey, []string{oidcMockServer.Config.ClientID})
+		_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+		headers := jws.NewHeaders()
+		_ = headers.Set(jws.KeyIDKey, oidcMockServer.DefaultHeaders()["kid"])
+		signed, err := jwt.Sign(token, jwa.HS256, publicKeyPEM, jwt.WithHeaders(headers))
+		if err != nil {
+			t.Fatalf("unable to sign HS256 token: %v", err)
+		}
+		return string(signed)
+	}
+	fixedKey, _ := jwk.New(&oidcMockServer.RSAKey.PublicKey)
+
+	tests := []struct {
+		name     string
+		options  Options
+		rawToken string
+		wantErr  error
+	}{
+		{
+			name:     "default options",
+			rawToken: signWithPublicKey(oidcMockServer.Server.URL),
+			wantErr:  ErrDisallowedAlg,
+		}, {
+			name: "HS256 allowed for another issuer",
+			options: Options{
+				AllowedAlgorithms:  []jwa.SignatureAlgorithm{jwa.RS256, jwa.HS256},
+				SymmetricKey:       []byte("0123456789abcdef0123456789abcdef"),
+				SymmetricKeyIssuer: "https://orders.internal",
+			},
+			rawToken: signWithPublicKey(oidcMockServer.Server.URL),
+			wantErr:  ErrUntrustedIssuer,
+		}, {
+			name: "HS256 token of the other issuer",
+			options: Options{
+				AllowedAlgorithms:  []jwa.SignatureAlgorithm{jwa.RS256, jwa.HS256},
+				SymmetricKey:       []byte("0123456789abcdef0123456789abcdef"),
+				SymmetricKeyIssuer: "https://orders.internal",
+			},
+			rawToken: signWithPublicKey("https://orders.internal"),
+			wantErr:  ErrInvalidSignature,
+		}, {
+			name: "KeyFunc returning the RSA key",
+			options: Options{
+				KeyFunc: func(context.Context, Token) (jwk.Key, error) { return fixedKey, nil },
+			},
+			rawToken: signWithPublicKey(oidcMockServer.Server.URL),
+			wantErr:  ErrDisallowedAlg,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.HTTPClient = oidcMockServer.Server.Client()
+			m := NewMiddleware(oidcMockServer.Config, tt.options)
+			defer m.Close()
+			if _, err := m.parseAndValidateJWT(context.Background(), tt.rawToken); !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseAndValidateJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyAlgorithm(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error creating test setup: %v", err)
+	}
+	rsaJWK, _ := jwk.New(&rsaKey.PublicKey)
+	rs256JWK, _ := jwk.New(&rsaKey.PublicKey)
+	_ = rs256JWK.Set(jwk.AlgorithmKey, jwa.RS256)
+	secretJWK, _ := jwk.New([]byte("0123456789abcdef0123456789abcdef"))
+
+	tests := []struct {
+		name    string
+		key     jwk.Key
+		alg     jwa.SignatureAlgorithm
+		wantErr bool
+	}{
+		{name: "rsa key for RS256", key: rsaJWK, alg: jwa.RS256},
+		{name: "rsa key for PS256", key: rsaJWK, alg: jwa.PS256},
+		{name: "rsa key for HS256", key: rsaJWK, alg: jwa.HS256, wantErr: true},
+		{name: "rsa key for ES256", key: rsaJWK, alg: jwa.ES256, wantErr: true},
+		{name: "RS256 key for PS256", key: rs256JWK, alg: jwa.PS256, wantErr: true},
+		{name: "symmetric key for RS256", key: secretJWK, alg: jwa.RS256, wantErr: true},
+		{name: "symmetric key for HS256", key: secretJWK, alg: jwa.HS256, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyKeyAlgorithm(tt.key, tt.alg)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidSignature)) {
+				t.Errorf("verifyKeyAlgorithm() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
 	}
 }
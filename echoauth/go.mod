@@ -0,0 +1,12 @@
+module github.com/sap/cloud-security-client-go/echoauth
+
+go 1.16
+
+require (
+	github.com/labstack/echo/v4 v4.6.3
+	github.com/sap/cloud-security-client-go v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.7.2
+)
+
+// the adapter is developed together with the library, releases require the tagged version of the library instead
+replace github.com/sap/cloud-security-client-go => ../
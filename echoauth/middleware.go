@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package echoauth provides an Echo middleware which authenticates requests with the auth.Middleware.
+// It is a separate package, so that applications which don't use Echo don't depend on it.
+package echoauth
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"github.com/sap/cloud-security-client-go/auth"
+)
+
+// TokenKey is the key of the Token in the echo.Context, see ClaimsFromEchoContext
+const TokenKey = "github.com/sap/cloud-security-client-go/auth.Token"
+
+// Middleware authenticates requests with the token extracted by auth.Options.TokenExtractor and stores the Token in the echo.Context,
+// see ClaimsFromEchoContext. The Token is also injected into the request context, see auth.ClaimsFromContext.
+// If the authentication does not succeed, an *echo.HTTPError with the status of auth.ErrorStatusCode, i.e. 401 or 403, is returned,
+// which wraps the authentication error as Internal. The WWW-Authenticate header of auth.BearerChallenge is set on the response.
+func Middleware(m *auth.Middleware) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, err := m.Authenticate(c.Request())
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, auth.BearerChallenge(err))
+				return echo.NewHTTPError(auth.ErrorStatusCode(err), err.Error()).SetInternal(err)
+			}
+			c.Set(TokenKey, token)
+			c.SetRequest(c.Request().WithContext(token.NewContext(c.Request().Context())))
+			return next(c)
+		}
+	}
+}
+
+// ClaimsFromEchoContext retrieves the Token of a request which has been authenticated by Middleware. The second return value reports whether a Token is present.
+func ClaimsFromEchoContext(c echo.Context) (auth.Token, bool) {
+	token, ok := c.Get(TokenKey).(auth.Token)
+	return token, ok
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package echoauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/auth"
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+func TestMiddleware(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	require.NoError(t, err, "error creating test setup")
+	defer oidcMockServer.Server.Close()
+	middleware := auth.NewMiddleware(oidcMockServer.Config, auth.Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	e := echo.New()
+	e.Use(Middleware(middleware))
+	e.GET("/helloWorld", func(c echo.Context) error {
+		token, ok := ClaimsFromEchoContext(c)
+		require.True(t, ok, "token expected in echo context")
+		ctxToken, ok := auth.ClaimsFromContext(c.Request().Context())
+		require.True(t, ok, "token expected in request context")
+		assert.Equal(t, token.Email(), ctxToken.Email())
+		return c.String(http.StatusOK, token.Email())
+	})
+
+	validToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+	expiredToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		ExpiresAt(time.Now().Add(-2*time.Minute)).
+		Build(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+
+	tests := []struct {
+		name       string
+		authz      string
+		wantStatus int
+	}{
+		{
+			name:       "valid",
+			authz:      "Bearer " + validToken,
+			wantStatus: http.StatusOK,
+		}, {
+			name:       "expired",
+			authz:      "Bearer " + expiredToken,
+			wantStatus: http.StatusUnauthorized,
+		}, {
+			name:       "no authorization header",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/helloWorld", http.NoBody)
+			if tt.authz != "" {
+				req.Header.Set("Authorization", tt.authz)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, oidcMockServer.DefaultClaims().Email, rec.Body.String())
+			} else {
+				assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestMiddleware_httpError(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	require.NoError(t, err, "error creating test setup")
+	defer oidcMockServer.Server.Close()
+	middleware := auth.NewMiddleware(oidcMockServer.Config, auth.Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/helloWorld", http.NoBody), httptest.NewRecorder())
+	err = Middleware(middleware)(func(c echo.Context) error {
+		t.Error("next handler must not be called for an unauthenticated request")
+		return nil
+	})(c)
+
+	var httpErr *echo.HTTPError
+	require.True(t, errors.As(err, &httpErr), "expected *echo.HTTPError, got %T", err)
+	assert.Equal(t, http.StatusUnauthorized, httpErr.Code)
+	assert.ErrorIs(t, httpErr.Internal, auth.ErrNoToken)
+	_, ok := ClaimsFromEchoContext(c)
+	assert.False(t, ok)
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GetConfigFromFile reads the IAS config from a JSON or YAML file, e.g. for local development or deployments outside of SAP BTP.
+// The format is determined by the file extension: .json, .yaml or .yml. The file provides the credentials of the identity binding,
+// i.e. the same keys as DefaultIdentity, like "clientid", "clientsecret", "url" and "domains". Client id, url and domains are required.
+// As for ParseIdentityConfig, IAS_ISSUER_OVERRIDE and IAS_DOMAIN_OVERRIDE take precedence over the url and domains of the file.
+func GetConfigFromFile(configPath string) (Identity, error) {
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file '%s': %w", configPath, err)
+	}
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+	case ".yaml", ".yml":
+		// the keys of the YAML file are mapped like the JSON keys of DefaultIdentity
+		var v interface{}
+		if err := yaml.Unmarshal(content, &v); err != nil {
+			return nil, fmt.Errorf("cannot parse config file '%s': %w", configPath, err)
+		}
+		if content, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("cannot parse config file '%s': %w", configPath, err)
+		}
+	default:
+		return nil, fmt.Errorf("cannot parse config file '%s': unsupported file extension, use .json, .yaml or .yml", configPath)
+	}
+
+	var identity DefaultIdentity
+	if err := json.Unmarshal(content, &identity); err != nil {
+		return nil, fmt.Errorf("cannot parse config file '%s': %w", configPath, err)
+	}
+	if err := applyOverrides(&identity); err != nil {
+		return nil, err
+	}
+	if err := validateConfigFile(identity); err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %w", configPath, err)
+	}
+	return &identity, nil
+}
+
+func validateConfigFile(identity DefaultIdentity) error {
+	var missing []string
+	if identity.ClientID == "" {
+		missing = append(missing, "clientid")
+	}
+	if identity.URL == "" {
+		missing = append(missing, "url")
+	}
+	if len(identity.GetDomains()) == 0 {
+		missing = append(missing, "domains")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	if u, err := url.Parse(identity.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("url '%s' must be an absolute URL", identity.URL)
+	}
+	return nil
+}
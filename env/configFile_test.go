@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package env
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetConfigFromFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		want        Identity
+		errContains string
+	}{
+		{name: "json", file: "identity.json", want: testConfig},
+		{name: "yaml", file: "identity.yaml", want: testConfig},
+		{name: "malformed json", file: "malformed.json", errContains: "cannot parse config file"},
+		{name: "malformed yaml", file: "malformed.yaml", errContains: "cannot parse config file"},
+		{name: "missing required fields", file: "missing-fields.json", errContains: "missing required fields: clientid, url"},
+		{name: "relative url", file: "relative-url.yml", errContains: "must be an absolute URL"},
+		{name: "unsupported extension", file: "identity.txt", errContains: "unsupported file extension"},
+		{name: "not existing", file: "not-existing.json", errContains: "cannot read config file"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetConfigFromFile(path.Join("testdata", "file", tt.file))
+			if tt.errContains != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -6,9 +6,13 @@ package env
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
@@ -19,6 +23,10 @@ const iasSecretKeyDefault = "credentials"
 const vcapServicesEnvKey = "VCAP_SERVICES"
 const iasConfigPathKey = "IAS_CONFIG_PATH"
 const iasConfigPathDefault = "/etc/secrets/sapbtp/identity"
+const serviceBindingRootKey = "SERVICE_BINDING_ROOT"
+const serviceBindingTypeFile = "type"
+const issuerOverrideEnvKey = "IAS_ISSUER_OVERRIDE"
+const domainOverrideEnvKey = "IAS_DOMAIN_OVERRIDE"
 
 // VCAPServices is the Cloud Foundry environment variable that stores information about services bound to the application
 type VCAPServices struct {
@@ -46,6 +54,7 @@ type DefaultIdentity struct {
 	ClientID             string    `json:"clientid"`
 	ClientSecret         string    `json:"clientsecret"`
 	Domains              []string  `json:"domains"`
+	Domain               string    `json:"domain"`
 	URL                  string    `json:"url"`
 	ZoneUUID             uuid.UUID `json:"zone_uuid"`
 	ProofTokenURL        string    `json:"prooftoken_url"`
@@ -55,8 +64,56 @@ type DefaultIdentity struct {
 	CertificateExpiresAt string    `json:"certificate_expires_at"`
 }
 
-// ParseIdentityConfig parses the IAS config from the applications environment
+// ParseIdentityConfig parses the IAS config from the applications environment.
+// If SERVICE_BINDING_ROOT is set, the binding of type identity is read from the files mounted below it, see https://servicebinding.io.
+// Without such a binding, e.g. if the directory does not exist, the binding of the detected platform is read instead.
+// The environment variables IAS_ISSUER_OVERRIDE and IAS_DOMAIN_OVERRIDE take precedence over the url and domains of the binding, see applyOverrides.
 func ParseIdentityConfig() (Identity, error) {
+	identity, err := parseIdentityConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// applyOverrides replaces the url of the identity with IAS_ISSUER_OVERRIDE and its domains with the comma-separated IAS_DOMAIN_OVERRIDE if set,
+// e.g. behind a reverse proxy which rewrites the hostnames of the IAS tenant.
+func applyOverrides(identity *DefaultIdentity) error {
+	if issuer := strings.TrimSpace(os.Getenv(issuerOverrideEnvKey)); issuer != "" {
+		if u, err := url.Parse(issuer); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s '%s' must be an absolute URL", issuerOverrideEnvKey, issuer)
+		}
+		identity.URL = issuer
+	}
+	if domains := os.Getenv(domainOverrideEnvKey); strings.TrimSpace(domains) != "" {
+		identity.Domains = nil
+		for _, domain := range strings.Split(domains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				identity.Domains = append(identity.Domains, domain)
+			}
+		}
+		identity.Domain = ""
+	}
+	return nil
+}
+
+func parseIdentityConfig() (*DefaultIdentity, error) {
+	if bindingRoot := os.Getenv(serviceBindingRootKey); bindingRoot != "" {
+		identities, err := readServiceBindings(bindingRoot, iasServiceName)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// buildpacks set SERVICE_BINDING_ROOT without mounting any binding, the detection of the platform applies then, as if no identity binding is found
+		case err != nil:
+			return nil, fmt.Errorf("cannot read '%s' service binding from %s '%s': %w", iasServiceName, serviceBindingRootKey, bindingRoot, err)
+		case len(identities) > 1:
+			return nil, fmt.Errorf("found more than one '%s' service binding from %s '%s'. This is currently not supported", iasServiceName, serviceBindingRootKey, bindingRoot)
+		case len(identities) == 1:
+			return &identities[0], nil
+		}
+	}
 	switch getPlatform() { //nolint:exhaustive // Unknown case is handled by default
 	case cloudFoundry:
 		var vcapServices VCAPServices
@@ -77,7 +134,7 @@ func ParseIdentityConfig() (Identity, error) {
 		if secretPath == "" {
 			secretPath = iasConfigPathDefault
 		}
-		identities, err := readServiceBindings(secretPath)
+		identities, err := readServiceBindings(secretPath, "")
 		if err != nil || len(identities) == 0 {
 			return nil, fmt.Errorf("cannot find '%s' service binding from secret path '%s'", iasServiceName, secretPath)
 		} else if len(identities) > 1 {
@@ -89,7 +146,9 @@ func ParseIdentityConfig() (Identity, error) {
 	}
 }
 
-func readServiceBindings(secretPath string) ([]DefaultIdentity, error) {
+// readServiceBindings reads the service instances bound as directories below secretPath.
+// If serviceType is not empty, only directories are considered whose type file contains serviceType.
+func readServiceBindings(secretPath string, serviceType string) ([]DefaultIdentity, error) {
 	instancesBound, err := os.ReadDir(secretPath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read service directory '%s' for identity service: %w", secretPath, err)
@@ -100,6 +159,9 @@ func readServiceBindings(secretPath string) ([]DefaultIdentity, error) {
 			continue
 		}
 		serviceInstancePath := path.Join(secretPath, instanceBound.Name())
+		if serviceType != "" && !hasServiceType(serviceInstancePath, serviceType) {
+			continue
+		}
 		instanceSecretFiles, err := os.ReadDir(serviceInstancePath)
 		if err != nil {
 			return nil, fmt.Errorf("cannot read service instance directory '%s' for '%s' service instance '%s': %w", serviceInstancePath, iasServiceName, instanceBound.Name(), err)
@@ -120,6 +182,11 @@ func readServiceBindings(secretPath string) ([]DefaultIdentity, error) {
 	return identities, nil
 }
 
+func hasServiceType(serviceInstancePath string, serviceType string) bool {
+	content, err := os.ReadFile(path.Join(serviceInstancePath, serviceBindingTypeFile))
+	return err == nil && strings.TrimSpace(string(content)) == serviceType
+}
+
 func readCredentialsFileToJSON(serviceInstancePath string, instanceSecretFiles []os.DirEntry) ([]byte, error) {
 	for _, instanceSecretFile := range instanceSecretFiles {
 		if !instanceSecretFile.IsDir() && instanceSecretFile.Name() == iasSecretKeyDefault {
@@ -178,8 +245,11 @@ func (c DefaultIdentity) GetURL() string {
 	return c.URL
 }
 
-// GetDomains implements the env.Identity interface.
+// GetDomains implements the env.Identity interface. Bindings which only provide a single domain are returned as a one element slice.
 func (c DefaultIdentity) GetDomains() []string {
+	if len(c.Domains) == 0 && c.Domain != "" {
+		return []string{c.Domain}
+	}
 	return c.Domains
 }
 
@@ -13,6 +13,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testConfig = &DefaultIdentity{
@@ -119,6 +120,90 @@ func TestX509BasedCredentials(t *testing.T) {
 	assert.True(t, got.IsCertificateBased())
 }
 
+func TestParseIdentityConfig_serviceBindingRoot(t *testing.T) {
+	bindingRoot := t.TempDir()
+	writeBinding := func(name string, files map[string]string) {
+		bindingPath := path.Join(bindingRoot, name)
+		require.NoError(t, os.Mkdir(bindingPath, 0o700))
+		for file, content := range files {
+			require.NoError(t, os.WriteFile(path.Join(bindingPath, file), []byte(content), 0o600))
+		}
+	}
+	writeBinding("my-ias", map[string]string{
+		"type":         "identity",
+		"clientid":     testConfig.ClientID,
+		"clientsecret": testConfig.ClientSecret,
+		"url":          testConfig.URL,
+		"domains":      `["accounts400.ondemand.com", "my.arbitrary.domain"]`,
+		"zone_uuid":    testConfig.ZoneUUID.String(),
+	})
+	writeBinding("my-xsuaa", map[string]string{
+		"type":     "xsuaa",
+		"clientid": "sb-my-app!t1234",
+	})
+	defer func() { require.NoError(t, clearTestEnv()) }()
+
+	// SERVICE_BINDING_ROOT takes precedence over VCAP_SERVICES
+	require.NoError(t, setTestEnv(`{"identity":[{"credentials":{"clientid":"from-vcap-services"}}]}`))
+	require.NoError(t, os.Setenv("SERVICE_BINDING_ROOT", bindingRoot))
+	got, err := ParseIdentityConfig()
+	require.NoError(t, err)
+	assert.Equal(t, testConfig, got)
+
+	writeBinding("my-other-ias", map[string]string{
+		"type":     "identity",
+		"clientid": "other",
+	})
+	_, err = ParseIdentityConfig()
+	assert.Error(t, err, "multiple identity bindings are not supported")
+
+	require.NoError(t, os.Unsetenv("SERVICE_BINDING_ROOT"))
+	got, err = ParseIdentityConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "from-vcap-services", got.GetClientID())
+
+	// the platform detection applies if SERVICE_BINDING_ROOT provides no identity binding, e.g. as set by buildpacks
+	for _, root := range []string{t.TempDir(), path.Join(bindingRoot, "does-not-exist")} {
+		require.NoError(t, os.Setenv("SERVICE_BINDING_ROOT", root))
+		got, err = ParseIdentityConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "from-vcap-services", got.GetClientID())
+	}
+}
+
+func TestParseIdentityConfig_overrides(t *testing.T) {
+	defer func() { require.NoError(t, clearTestEnv()) }()
+	require.NoError(t, setTestEnv(`{"identity":[{"credentials":{"clientid":"my-client","url":"https://mytenant.accounts400.ondemand.com","domains":["accounts400.ondemand.com"]}}]}`))
+
+	got, err := ParseIdentityConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "https://mytenant.accounts400.ondemand.com", got.GetURL())
+
+	require.NoError(t, os.Setenv(issuerOverrideEnvKey, "https://ias.proxy.example.org"))
+	require.NoError(t, os.Setenv(domainOverrideEnvKey, "proxy.example.org, accounts400.ondemand.com"))
+	got, err = ParseIdentityConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "https://ias.proxy.example.org", got.GetURL(), "the issuer override must win over the binding")
+	assert.Equal(t, []string{"proxy.example.org", "accounts400.ondemand.com"}, got.GetDomains(), "the domain override must win over the binding")
+	assert.Equal(t, "my-client", got.GetClientID())
+
+	got, err = GetConfigFromFile(path.Join("testdata", "file", "identity.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://ias.proxy.example.org", got.GetURL(), "the issuer override must win over the config file")
+	assert.Equal(t, []string{"proxy.example.org", "accounts400.ondemand.com"}, got.GetDomains())
+
+	require.NoError(t, os.Setenv(issuerOverrideEnvKey, "ias.proxy.example.org"))
+	_, err = ParseIdentityConfig()
+	assert.Error(t, err, "relative issuer override must be rejected")
+}
+
+func TestDefaultIdentity_GetDomains(t *testing.T) {
+	assert.Equal(t, []string{"accounts400.ondemand.com", "my.arbitrary.domain"}, testConfig.GetDomains())
+	assert.Equal(t, []string{"accounts400.ondemand.com"}, DefaultIdentity{Domain: "accounts400.ondemand.com"}.GetDomains())
+	assert.Equal(t, []string{"my.arbitrary.domain"}, DefaultIdentity{Domain: "accounts400.ondemand.com", Domains: []string{"my.arbitrary.domain"}}.GetDomains())
+	assert.Empty(t, DefaultIdentity{}.GetDomains())
+}
+
 // TODO go 1.17 supports T.SetEnv https://pkg.go.dev/testing#T.Setenv
 // Cleanup when go 1.18 is released
 func setTestEnv(vcapServices string) error {
@@ -164,5 +249,14 @@ func clearTestEnv() error {
 	if err != nil {
 		return fmt.Errorf("error cleaning up after test: could not unset env IAS_CONFIG_PATH: %w", err)
 	}
+	err = os.Unsetenv("SERVICE_BINDING_ROOT")
+	if err != nil {
+		return fmt.Errorf("error cleaning up after test: could not unset env SERVICE_BINDING_ROOT: %w", err)
+	}
+	for _, key := range []string{issuerOverrideEnvKey, domainOverrideEnvKey} {
+		if err = os.Unsetenv(key); err != nil {
+			return fmt.Errorf("error cleaning up after test: could not unset env %s: %w", key, err)
+		}
+	}
 	return nil
 }
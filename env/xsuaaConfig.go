@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const xsuaaServiceName = "xsuaa"
+
+// XSUAAConfig represents the parsed credentials from the xsuaa binding
+type XSUAAConfig struct {
+	ClientID        string `json:"clientid"`
+	ClientSecret    string `json:"clientsecret"`
+	URL             string `json:"url"`
+	UAADomain       string `json:"uaadomain"`
+	XSAppName       string `json:"xsappname"`
+	IdentityZone    string `json:"identityzone"`
+	IdentityZoneID  string `json:"identityzoneid"`
+	TenantID        string `json:"tenantid"`
+	CredentialType  string `json:"credential-type"`
+	Certificate     string `json:"certificate"`
+	Key             string `json:"key"`
+	CertificateURL  string `json:"certurl"`
+	VerificationKey string `json:"verificationkey"`
+}
+
+type xsuaaVCAPServices struct {
+	XSUAA []struct {
+		Plan        string      `json:"plan"`
+		Credentials XSUAAConfig `json:"credentials"`
+	} `json:"xsuaa"`
+}
+
+// ParseXSUAAConfig parses the XSUAA config from the VCAP_SERVICES environment variable of Cloud Foundry applications.
+// If multiple xsuaa service instances are bound, plan selects the instance, e.g. "application" or "broker". An empty plan requires exactly one bound instance.
+func ParseXSUAAConfig(plan string) (*XSUAAConfig, error) {
+	if getPlatform() != cloudFoundry {
+		return nil, fmt.Errorf("unable to parse '%s' service config: %s is not set", xsuaaServiceName, vcapServicesEnvKey)
+	}
+	var vcapServices xsuaaVCAPServices
+	if err := json.Unmarshal([]byte(os.Getenv(vcapServicesEnvKey)), &vcapServices); err != nil {
+		return nil, fmt.Errorf("cannot parse vcap services: %w", err)
+	}
+
+	var configs []XSUAAConfig
+	for _, instance := range vcapServices.XSUAA {
+		if plan == "" || instance.Plan == plan {
+			configs = append(configs, instance.Credentials)
+		}
+	}
+	switch {
+	case len(configs) == 0 && plan == "":
+		return nil, fmt.Errorf("no '%s' service instance bound to the application", xsuaaServiceName)
+	case len(configs) == 0:
+		return nil, fmt.Errorf("no '%s' service instance with plan '%s' bound to the application", xsuaaServiceName, plan)
+	case len(configs) > 1 && plan == "":
+		return nil, fmt.Errorf("more than one '%s' service instance bound to the application, select one by plan", xsuaaServiceName)
+	case len(configs) > 1:
+		return nil, fmt.Errorf("more than one '%s' service instance with plan '%s' bound to the application. This is currently not supported", xsuaaServiceName, plan)
+	}
+	return &configs[0], nil
+}
@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package env
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseXSUAAConfig(t *testing.T) {
+	vcapServices, err := os.ReadFile(path.Join("testdata", "cf", "vcap_services_xsuaa.json"))
+	require.NoError(t, err, "error preparing test")
+
+	tests := []struct {
+		name          string
+		env           string
+		plan          string
+		wantClientID  string
+		wantXSAppName string
+		wantErr       bool
+	}{
+		{
+			name:          "select application plan",
+			env:           string(vcapServices),
+			plan:          "application",
+			wantClientID:  "sb-my-app!t1234",
+			wantXSAppName: "my-app!t1234",
+		}, {
+			name:          "select broker plan",
+			env:           string(vcapServices),
+			plan:          "broker",
+			wantClientID:  "sb-my-broker!b1234",
+			wantXSAppName: "my-broker!b1234",
+		}, {
+			name:    "multiple instances without plan",
+			env:     string(vcapServices),
+			wantErr: true,
+		}, {
+			name:    "unknown plan",
+			env:     string(vcapServices),
+			plan:    "space",
+			wantErr: true,
+		}, {
+			name:          "single instance without plan",
+			env:           `{"xsuaa":[{"plan":"application","credentials":{"clientid":"sb-my-app!t1234","xsappname":"my-app!t1234"}}]}`,
+			wantClientID:  "sb-my-app!t1234",
+			wantXSAppName: "my-app!t1234",
+		}, {
+			name:    "no xsuaa service binding",
+			env:     `{"identity":[]}`,
+			wantErr: true,
+		}, {
+			name:    "invalid vcap services",
+			env:     `{"xsuaa":`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, setTestEnv(tt.env))
+			defer func() { require.NoError(t, clearTestEnv()) }()
+
+			got, err := ParseXSUAAConfig(tt.plan)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantClientID, got.ClientID)
+			assert.Equal(t, tt.wantXSAppName, got.XSAppName)
+		})
+	}
+}
+
+func TestParseXSUAAConfig_credentials(t *testing.T) {
+	vcapServices, err := os.ReadFile(path.Join("testdata", "cf", "vcap_services_xsuaa.json"))
+	require.NoError(t, err, "error preparing test")
+	require.NoError(t, setTestEnv(string(vcapServices)))
+	defer func() { require.NoError(t, clearTestEnv()) }()
+
+	got, err := ParseXSUAAConfig("application")
+	require.NoError(t, err)
+	assert.Equal(t, &XSUAAConfig{
+		ClientID:        "sb-my-app!t1234",
+		ClientSecret:    "[the_CLIENT.secret:3[/abc",
+		URL:             "https://mysubaccount.authentication.eu10.hana.ondemand.com",
+		UAADomain:       "authentication.eu10.hana.ondemand.com",
+		XSAppName:       "my-app!t1234",
+		IdentityZone:    "mysubaccount",
+		IdentityZoneID:  "bef12345-de57-480f-be92-1d8c1c7abf16",
+		TenantID:        "bef12345-de57-480f-be92-1d8c1c7abf16",
+		CredentialType:  "binding-secret",
+		VerificationKey: "-----BEGIN PUBLIC KEY-----MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA-----END PUBLIC KEY-----",
+	}, got)
+}
+
+func TestParseXSUAAConfig_notOnCloudFoundry(t *testing.T) {
+	require.NoError(t, clearTestEnv())
+	_, err := ParseXSUAAConfig("")
+	assert.Error(t, err)
+}
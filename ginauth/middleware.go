@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ginauth provides a Gin middleware which authenticates requests with the auth.Middleware.
+// It is a separate package, so that applications which don't use Gin don't depend on it.
+package ginauth
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/sap/cloud-security-client-go/auth"
+)
+
+// TokenKey is the key of the Token in the gin.Context, see ClaimsFromGinContext
+const TokenKey = "github.com/sap/cloud-security-client-go/auth.Token"
+
+// Middleware authenticates requests with the token extracted by auth.Options.TokenExtractor and stores the Token in the gin.Context,
+// see ClaimsFromGinContext. The Token is also injected into the request context, see auth.ClaimsFromContext.
+// If the authentication does not succeed, the request is aborted with the status of auth.ErrorStatusCode, i.e. 401 or 403,
+// and the WWW-Authenticate header of auth.BearerChallenge. The error is attached to the gin.Context, see gin.Context.Errors.
+func Middleware(m *auth.Middleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := m.Authenticate(c.Request)
+		if err != nil {
+			_ = c.Error(err)
+			c.Header("WWW-Authenticate", auth.BearerChallenge(err))
+			c.AbortWithStatus(auth.ErrorStatusCode(err))
+			return
+		}
+		c.Set(TokenKey, token)
+		c.Request = c.Request.WithContext(token.NewContext(c.Request.Context()))
+		c.Next()
+	}
+}
+
+// ClaimsFromGinContext retrieves the Token of a request which has been authenticated by Middleware. The second return value reports whether a Token is present.
+func ClaimsFromGinContext(c *gin.Context) (auth.Token, bool) {
+	value, exists := c.Get(TokenKey)
+	if !exists {
+		return auth.Token{}, false
+	}
+	token, ok := value.(auth.Token)
+	return token, ok
+}
@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ginauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sap/cloud-security-client-go/auth"
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+func TestMiddleware(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	require.NoError(t, err, "error creating test setup")
+	defer oidcMockServer.Server.Close()
+	middleware := auth.NewMiddleware(oidcMockServer.Config, auth.Options{HTTPClient: oidcMockServer.Server.Client()})
+	defer middleware.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware(middleware))
+	router.GET("/helloWorld", func(c *gin.Context) {
+		token, ok := ClaimsFromGinContext(c)
+		require.True(t, ok, "token expected in gin context")
+		ctxToken, ok := auth.ClaimsFromContext(c.Request.Context())
+		require.True(t, ok, "token expected in request context")
+		assert.Equal(t, token.Email(), ctxToken.Email())
+		c.String(http.StatusOK, token.Email())
+	})
+
+	validToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+	expiredToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		ExpiresAt(time.Now().Add(-2*time.Minute)).
+		Build(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+
+	tests := []struct {
+		name       string
+		authz      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "valid",
+			authz:      "Bearer " + validToken,
+			wantStatus: http.StatusOK,
+			wantBody:   oidcMockServer.DefaultClaims().Email,
+		}, {
+			name:       "expired",
+			authz:      "Bearer " + expiredToken,
+			wantStatus: http.StatusUnauthorized,
+		}, {
+			name:       "no authorization header",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/helloWorld", http.NoBody)
+			if tt.authz != "" {
+				req.Header.Set("Authorization", tt.authz)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantBody, rec.Body.String())
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestClaimsFromGinContext_missing(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	_, ok := ClaimsFromGinContext(c)
+	assert.False(t, ok)
+}
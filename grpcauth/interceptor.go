@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package grpcauth provides gRPC server interceptors which authenticate calls with the auth.Middleware.
+package grpcauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/sap/cloud-security-client-go/auth"
+)
+
+const authorization string = "authorization"
+
+// Option configures the interceptors
+type Option func(*options)
+
+type options struct {
+	metadataKey string
+}
+
+// WithMetadataKey reads the token from the given metadata key instead of 'authorization', e.g. 'x-jwt-assertion' as forwarded by some gateways.
+// The value of a custom key may either be the raw token or carry the 'Bearer ' prefix.
+func WithMetadataKey(key string) Option {
+	return func(o *options) {
+		o.metadataKey = strings.ToLower(key)
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{metadataKey: authorization}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// UnaryServerInterceptor authenticates unary calls with the bearer token of the 'authorization' metadata, see WithMetadataKey, and injects the Token into the context,
+// see auth.ClaimsFromContext. If the authentication does not succeed, the call fails with codes.Unauthenticated,
+// or codes.PermissionDenied if the token lacks any of the auth.Options.RequiredScopes.
+func UnaryServerInterceptor(m *auth.Middleware, opts ...Option) grpc.UnaryServerInterceptor {
+	o := newOptions(opts)
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, m, o)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authenticates streaming calls with the bearer token of the 'authorization' metadata, see WithMetadataKey, and injects the Token into the
+// context of the stream, see auth.ClaimsFromContext. If the authentication does not succeed, the call fails with codes.Unauthenticated,
+// or codes.PermissionDenied if the token lacks any of the auth.Options.RequiredScopes.
+func StreamServerInterceptor(m *auth.Middleware, opts ...Option) grpc.StreamServerInterceptor {
+	o := newOptions(opts)
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), m, o)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func authenticate(ctx context.Context, m *auth.Middleware, o options) (context.Context, error) {
+	rawToken, err := extractRawToken(ctx, o.metadataKey)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	token, err := m.ValidateToken(ctx, rawToken)
+	if errors.Is(err, auth.ErrInsufficientScope) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return token.NewContext(ctx), nil
+}
+
+func extractRawToken(ctx context.Context, key string) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authValue := range md.Get(key) {
+		splitAuthValue := strings.Fields(authValue)
+		if len(splitAuthValue) == 2 && strings.EqualFold(splitAuthValue[0], "bearer") {
+			return splitAuthValue[1], nil
+		}
+		if len(splitAuthValue) == 1 && key != authorization {
+			return splitAuthValue[0], nil
+		}
+	}
+	return "", errors.New("extracting token from request metadata failed")
+}
+
+// authenticatedStream overrides the context of the wrapped grpc.ServerStream
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context enriched with the Token
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package grpcauth
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/sap/cloud-security-client-go/auth"
+	"github.com/sap/cloud-security-client-go/mocks"
+)
+
+func TestInterceptors(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	require.NoError(t, err, "error creating test setup")
+	defer oidcMockServer.Server.Close()
+	middleware := auth.NewMiddleware(oidcMockServer.Config, auth.Options{HTTPClient: oidcMockServer.Server.Client()})
+
+	var email string
+	client := setupGRPCServer(t, middleware, func(ctx context.Context) {
+		token, _ := auth.ClaimsFromContext(ctx)
+		email = token.Email()
+	})
+
+	validToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+	expiredToken, err := oidcMockServer.SignToken(mocks.NewOIDCClaimsBuilder(oidcMockServer.DefaultClaims()).
+		ExpiresAt(time.Now().Add(-2*time.Minute)).
+		Build(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+
+	tests := []struct {
+		name     string
+		authz    string
+		wantCode codes.Code
+	}{
+		{
+			name:     "valid",
+			authz:    "Bearer " + validToken,
+			wantCode: codes.OK,
+		}, {
+			name:     "expired",
+			authz:    "Bearer " + expiredToken,
+			wantCode: codes.Unauthenticated,
+		}, {
+			name:     "no bearer scheme",
+			authz:    validToken,
+			wantCode: codes.Unauthenticated,
+		}, {
+			name:     "no authorization metadata",
+			wantCode: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if tt.authz != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, authorization, tt.authz)
+			}
+
+			email = ""
+			_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+			assert.Equal(t, tt.wantCode, status.Code(err), "unary call: %v", err)
+
+			stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			assert.Equal(t, tt.wantCode, status.Code(err), "stream call: %v", err)
+
+			if tt.wantCode == codes.OK {
+				assert.Equal(t, "foo@bar.org", email)
+			}
+		})
+	}
+}
+
+func TestInterceptors_metadataKey(t *testing.T) {
+	oidcMockServer, err := mocks.NewOIDCMockServer()
+	require.NoError(t, err, "error creating test setup")
+	defer oidcMockServer.Server.Close()
+	middleware := auth.NewMiddleware(oidcMockServer.Config, auth.Options{HTTPClient: oidcMockServer.Server.Client()})
+
+	var email string
+	client := setupGRPCServer(t, middleware, func(ctx context.Context) {
+		token, _ := auth.ClaimsFromContext(ctx)
+		email = token.Email()
+	}, WithMetadataKey("X-JWT-Assertion"))
+
+	validToken, err := oidcMockServer.SignToken(oidcMockServer.DefaultClaims(), oidcMockServer.DefaultHeaders())
+	require.NoError(t, err, "unable to sign provided test token")
+
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		wantCode codes.Code
+	}{
+		{
+			name:     "raw token",
+			key:      "x-jwt-assertion",
+			value:    validToken,
+			wantCode: codes.OK,
+		}, {
+			name:     "bearer token",
+			key:      "x-jwt-assertion",
+			value:    "Bearer " + validToken,
+			wantCode: codes.OK,
+		}, {
+			name:     "token in authorization metadata only",
+			key:      authorization,
+			value:    "Bearer " + validToken,
+			wantCode: codes.Unauthenticated,
+		}, {
+			name:     "no metadata",
+			wantCode: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if tt.key != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, tt.key, tt.value)
+			}
+
+			email = ""
+			_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+			assert.Equal(t, tt.wantCode, status.Code(err), "unary call: %v", err)
+
+			stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			assert.Equal(t, tt.wantCode, status.Code(err), "stream call: %v", err)
+
+			if tt.wantCode == codes.OK {
+				assert.Equal(t, "foo@bar.org", email)
+			}
+		})
+	}
+}
+
+func setupGRPCServer(t *testing.T, m *auth.Middleware, onAuthenticated func(ctx context.Context), opts ...Option) grpc_health_v1.HealthClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(m, opts...),
+			func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				onAuthenticated(ctx)
+				return handler(ctx, req)
+			}),
+		grpc.ChainStreamInterceptor(StreamServerInterceptor(m, opts...),
+			func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				onAuthenticated(ss.Context())
+				return handler(srv, ss)
+			}))
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err, "unable to dial in-memory grpc server")
+	t.Cleanup(func() { _ = conn.Close() })
+	return grpc_health_v1.NewHealthClient(conn)
+}
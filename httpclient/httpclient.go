@@ -8,12 +8,15 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/sap/cloud-security-client-go/env"
 )
 
+const defaultTimeout = 10 * time.Second
+
 // DefaultTLSConfig creates default tls.Config. Initializes SystemCertPool with cert/key from identity config.
 //
 // identity provides certificate and key
@@ -44,18 +47,30 @@ func DefaultTLSConfig(identity env.Identity) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
-// DefaultHTTPClient
+// DefaultHTTPClient creates a http.Client with a timeout of 10 seconds and an own transport, which pools connections
+// and limits the time to connect and to perform the TLS handshake.
 //
 // tlsConfig required in case of cert-based identity config
 func DefaultHTTPClient(tlsConfig *tls.Config) *http.Client {
-	client := &http.Client{
-		Timeout: time.Second * 10,
+	return &http.Client{
+		Timeout:   defaultTimeout,
+		Transport: defaultTransport(tlsConfig),
 	}
-	if tlsConfig != nil {
-		client.Transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
-			MaxIdleConns:    50,
-		}
+}
+
+func defaultTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: defaultTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
 	}
-	return client
 }
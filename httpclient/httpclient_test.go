@@ -5,8 +5,10 @@ package httpclient
 
 import (
 	_ "embed"
+	"net/http"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -50,6 +52,17 @@ func TestDefaultHTTPClient_ClientCredentials(t *testing.T) {
 	assert.NotNil(t, httpsClient)
 }
 
+func TestDefaultHTTPClient_Timeouts(t *testing.T) {
+	httpsClient := DefaultHTTPClient(nil)
+	assert.Equal(t, 10*time.Second, httpsClient.Timeout)
+	transport, ok := httpsClient.Transport.(*http.Transport)
+	assert.True(t, ok, "expected an own *http.Transport")
+	assert.NotSame(t, http.DefaultTransport, transport, "the shared http.DefaultTransport must not be used")
+	assert.NotZero(t, transport.TLSHandshakeTimeout)
+	assert.NotZero(t, transport.ResponseHeaderTimeout)
+	assert.NotZero(t, transport.MaxIdleConnsPerHost)
+}
+
 func TestDefaultTLSConfig_shouldFailIfKeyDoesNotMatch(t *testing.T) {
 	mTLSConfig.Certificate = otherKey
 	tlsConfig, err := DefaultTLSConfig(mTLSConfig)
@@ -5,6 +5,8 @@
 package mocks
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/sap/cloud-security-client-go/auth"
@@ -57,3 +59,41 @@ func TestMockServer_SignTokenWithAdditionalClaims(t *testing.T) {
 		})
 	}
 }
+
+func TestMockServer_MustSignToken(t *testing.T) {
+	oidcMockServer := NewTestOIDCMockServer(t)
+	middleware := auth.NewMiddleware(oidcMockServer.Config, auth.Options{HTTPClient: oidcMockServer.Server.Client()})
+
+	rawToken := oidcMockServer.MustSignToken(t, map[string]interface{}{
+		"email":  "john.doe@example.org",
+		"groups": []string{"admin"},
+	})
+	token, err := middleware.Authenticate(newBearerRequest(rawToken))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error = %v", err)
+	}
+	if email := token.Email(); email != "john.doe@example.org" {
+		t.Errorf("claim email not overridden: got %s", email)
+	}
+	if groups, err := token.GetClaimAsStringSlice("groups"); err != nil || len(groups) != 1 || groups[0] != "admin" {
+		t.Errorf("additional claim groups missing in token: %v, %v", groups, err)
+	}
+}
+
+func TestMockServer_MustSignToken_removeClaim(t *testing.T) {
+	oidcMockServer := NewTestOIDCMockServer(t)
+
+	token, err := auth.NewToken(oidcMockServer.MustSignToken(t, map[string]interface{}{"family_name": nil}))
+	if err != nil {
+		t.Fatalf("NewToken() unexpected error = %v", err)
+	}
+	if token.HasClaim("family_name") {
+		t.Errorf("default claim family_name not removed from token")
+	}
+}
+
+func newBearerRequest(rawToken string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+rawToken)
+	return req
+}
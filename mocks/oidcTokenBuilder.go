@@ -140,6 +140,24 @@ func (b *OIDCClaimsBuilder) ZoneID(zoneID string) *OIDCClaimsBuilder {
 	return b
 }
 
+// AppTID sets the app_tid field
+func (b *OIDCClaimsBuilder) AppTID(appTID string) *OIDCClaimsBuilder {
+	b.claims.AppTID = appTID
+	return b
+}
+
+// AuthTime sets the auth_time field
+func (b *OIDCClaimsBuilder) AuthTime(authTime time.Time) *OIDCClaimsBuilder {
+	b.claims.AuthTime = authTime.Unix()
+	return b
+}
+
+// AMR sets the amr field
+func (b *OIDCClaimsBuilder) AMR(methods ...string) *OIDCClaimsBuilder {
+	b.claims.AMR = methods
+	return b
+}
+
 // WithoutAudience removes the aud claim
 func (b *OIDCClaimsBuilder) WithoutAudience() *OIDCClaimsBuilder {
 	b.claims.Audience = nil
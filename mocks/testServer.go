@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// NewTestOIDCMockServer instantiates a new MockServer for the test tb, which is closed when tb and all its subtests complete.
+// Setup errors fail the test, so the server can be used without further error handling:
+//
+//	server := mocks.NewTestOIDCMockServer(t)
+//	middleware := auth.NewMiddleware(server.Config, auth.Options{HTTPClient: server.Server.Client()})
+//	rawToken := server.MustSignToken(t, map[string]interface{}{"email": "john.doe@example.org"})
+func NewTestOIDCMockServer(tb testing.TB) *MockServer {
+	tb.Helper()
+	server, err := NewOIDCMockServer()
+	if err != nil {
+		tb.Fatalf("unable to create OIDC mock server: %v", err)
+	}
+	tb.Cleanup(server.Server.Close)
+	return server
+}
+
+// MustSignToken signs a token with the DefaultClaims and DefaultHeaders of the MockServer, which is accepted by a Middleware configured with MockServer.Config.
+// The provided claims are added to or override the default claims, a nil value removes the default claim. Signing errors fail the test tb.
+func (m *MockServer) MustSignToken(tb testing.TB, claims map[string]interface{}) string {
+	tb.Helper()
+	var mapClaims map[string]interface{}
+	dataBytes, err := json.Marshal(m.DefaultClaims())
+	if err != nil {
+		tb.Fatalf("unable to convert OIDCClaims to map (marshal): %v", err)
+	}
+	if err = json.Unmarshal(dataBytes, &mapClaims); err != nil {
+		tb.Fatalf("unable to convert OIDCClaims to map (unmarshal): %v", err)
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(mapClaims, k)
+			continue
+		}
+		mapClaims[k] = v
+	}
+
+	token := jwt.New()
+	for k, v := range mapClaims {
+		if err = token.Set(k, v); err != nil {
+			tb.Fatalf("unable to set claim %s: %v", k, err)
+		}
+	}
+	signedToken, err := m.signToken(token, m.DefaultHeaders())
+	if err != nil {
+		tb.Fatalf("unable to sign token: %v", err)
+	}
+	return signedToken
+}
@@ -7,44 +7,86 @@ package oidcclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
-	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"golang.org/x/sync/singleflight"
 )
 
 const defaultJwkExpiration = 15 * time.Minute
+const defaultMinJWKsTTL = 1 * time.Minute
+const defaultMaxJWKsTTL = 24 * time.Hour
+const minJwkRefetchInterval = 1 * time.Minute
 const zoneIDHeader = "x-zone_uuid"
+const defaultDiscoveryPath = "/.well-known/openid-configuration"
+const maxResponseBytes = 1 << 20 // 1 MiB, far more than any discovery document or JWKs
+const jwksFetchTimeout = 30 * time.Second
+
+// ErrResponseTooLarge is returned if the body of a discovery or JWKs response exceeds 1 MiB, e.g. of a broken or malicious endpoint
+var ErrResponseTooLarge = errors.New("response body exceeds the size limit")
+
+// Options allows to configure the requests of the OIDCTenant
+type Options struct {
+	Retries        int           // Retries is the number of retries of discovery and JWKs requests, which failed with a connection error, 429 or 5xx response. Default: 0
+	RetryBaseDelay time.Duration // RetryBaseDelay is the delay before the first retry, it doubles with every further retry and is randomized by a jitter. Default: 0
+	MaxRetryAfter  time.Duration // MaxRetryAfter caps the delay requested by the Retry-After header of 429 and 503 responses, which replaces the backoff of the retry. Default: 10 seconds
+	JWKsURL        string        // JWKsURL overrides the 'jwks_uri' of the discovery, e.g. to fetch the JWKs from a mirror. Default: the discovered 'jwks_uri'
+	DiscoveryPath  string        // DiscoveryPath is the path of the discovery document on the host of the issuer. Default: /.well-known/openid-configuration
+	FetchBurst     int           // FetchBurst is the number of JWKs fetches allowed at once, further fetches return the cached keys or fail with ErrRateLimited. Default: 0, i.e. unlimited
+	FetchInterval  time.Duration // FetchInterval is the time after which one more JWKs fetch is allowed again, up to FetchBurst. Default: 0, i.e. unlimited
+	MinJWKsTTL     time.Duration // MinJWKsTTL is the lower bound of the 'max-age' of the JWKs response, i.e. the shortest time the keys are cached. Default: 1 minute
+	MaxJWKsTTL     time.Duration // MaxJWKsTTL is the upper bound of the 'max-age' of the JWKs response, i.e. the longest time the keys are cached. Default: 24 hours
+}
 
 // OIDCTenant represents one IAS tenant correlating with one zone with it's OIDC discovery results and cached JWKs
 type OIDCTenant struct {
 	ProviderJSON    ProviderJSON
+	Clock           func() time.Time // Clock returns the current time used for the expiry of the cached JWKs. Default: time.Now
 	acceptedZoneIds map[string]bool
 	httpClient      *http.Client
+	options         Options
 	// A set of cached keys and their expiry.
-	jwks       jwk.Set
-	jwksExpiry time.Time
-	mu         sync.RWMutex
+	jwks          jwk.Set
+	jwksExpiry    time.Time
+	jwksFetchedAt time.Time
+	jwksZoneID    string
+	fetchLimit    tokenBucket
+	mu            sync.RWMutex
+	sf            singleflight.Group // sf shares the JWKs fetch of a zone between concurrent callers
 }
 
 type updateKeysResult struct {
-	keys   jwk.Set
-	expiry time.Time
+	keys         jwk.Set
+	expiry       time.Time
+	zoneRejected bool // zoneRejected is set if the server answered definitively, but not with keys for the zone, see isZoneRejection
 }
 
 // NewOIDCTenant instantiates a new OIDCTenant and performs the OIDC discovery
-func NewOIDCTenant(httpClient *http.Client, targetIss *url.URL) (*OIDCTenant, error) {
+//
+// ctx carries the request context like the deadline or other values that should be shared across API boundaries.
+func NewOIDCTenant(ctx context.Context, httpClient *http.Client, targetIss *url.URL) (*OIDCTenant, error) {
+	return NewOIDCTenantWithOptions(ctx, httpClient, targetIss, Options{})
+}
+
+// NewOIDCTenantWithOptions instantiates a new OIDCTenant with the given Options and performs the OIDC discovery
+//
+// ctx carries the request context like the deadline or other values that should be shared across API boundaries.
+func NewOIDCTenantWithOptions(ctx context.Context, httpClient *http.Client, targetIss *url.URL, options Options) (*OIDCTenant, error) {
 	ks := new(OIDCTenant)
 	ks.httpClient = httpClient
+	ks.options = options
 	ks.acceptedZoneIds = make(map[string]bool)
-	err := ks.performDiscovery(targetIss.Host)
+	err := ks.performDiscovery(ctx, targetIss.Host)
 	if err != nil {
 		return nil, err
 	}
@@ -53,13 +95,15 @@ func NewOIDCTenant(httpClient *http.Client, targetIss *url.URL) (*OIDCTenant, er
 }
 
 // GetJWKs returns the validation keys either cached or updated ones
-func (ks *OIDCTenant) GetJWKs(zoneID string) (jwk.Set, error) {
+//
+// ctx carries the request context like the deadline or other values that should be shared across API boundaries.
+func (ks *OIDCTenant) GetJWKs(ctx context.Context, zoneID string) (jwk.Set, error) {
 	keys, err := ks.readJWKsFromMemory(zoneID)
 	if keys == nil {
 		if err != nil {
 			return nil, err
 		}
-		return ks.updateJWKsMemory(zoneID)
+		return ks.updateJWKs(ctx, zoneID)
 	}
 	return keys, nil
 }
@@ -71,7 +115,7 @@ func (ks *OIDCTenant) readJWKsFromMemory(zoneID string) (jwk.Set, error) {
 
 	isZoneAccepted, isZoneKnown := ks.acceptedZoneIds[zoneID]
 
-	if time.Now().Before(ks.jwksExpiry) && isZoneKnown {
+	if ks.now().Before(ks.jwksExpiry) && isZoneKnown {
 		if isZoneAccepted {
 			return ks.jwks, nil
 		}
@@ -80,70 +124,210 @@ func (ks *OIDCTenant) readJWKsFromMemory(zoneID string) (jwk.Set, error) {
 	return nil, nil
 }
 
-// updateJWKsMemory updates and returns the validation keys from memory, or error in case of invalid zone or nil, in case nothing found in memory
-func (ks *OIDCTenant) updateJWKsMemory(zoneID string) (jwk.Set, error) {
+// RefreshJWKs forces an update of the cached validation keys, e.g. in case the token references a key which is not cached yet after a key rotation.
+// To prevent flooding the server, the cached keys are returned if they have been fetched less than a minute ago.
+func (ks *OIDCTenant) RefreshJWKs(ctx context.Context, zoneID string) (jwk.Set, error) {
+	ks.mu.RLock()
+	jwks := ks.jwks
+	recentlyFetched := jwks != nil && ks.acceptedZoneIds[zoneID] && ks.now().Sub(ks.jwksFetchedAt) < minJwkRefetchInterval
+	ks.mu.RUnlock()
+
+	if recentlyFetched {
+		return jwks, nil
+	}
+	return ks.updateJWKs(ctx, zoneID)
+}
+
+// RefreshExpiringJWKs updates the cached validation keys in case they expire within leadTime, e.g. to refresh them in the background.
+// The keys are fetched for the zone of the last successful update.
+// The lock is not held during the fetch, so that a slow JWKs endpoint does not block the request path, which reads the cached keys meanwhile.
+// If the refresh fails, the cached keys and accepted zones are kept until they expire, so that a temporary outage of the server does not reject tokens.
+func (ks *OIDCTenant) RefreshExpiringJWKs(ctx context.Context, leadTime time.Duration) error {
 	ks.mu.Lock()
-	defer ks.mu.Unlock()
+	if ks.jwks == nil || ks.jwksExpiry.Sub(ks.now()) > leadTime || !ks.fetchLimit.allow(ks.now(), ks.options.FetchBurst, ks.options.FetchInterval) {
+		ks.mu.Unlock()
+		return nil
+	}
+	zoneID := ks.jwksZoneID
+	ks.mu.Unlock()
 
-	updatedKeys, err := ks.getJWKsFromServer(zoneID)
+	result, err := ks.getJWKsFromServer(ctx, zoneID)
 	if err != nil {
-		return nil, fmt.Errorf("error updating JWKs: %v", err)
+		return fmt.Errorf("error updating JWKs: %w", err)
 	}
-	keysResult := updatedKeys.(updateKeysResult)
 
-	ks.jwksExpiry = keysResult.expiry
-	ks.jwks = keysResult.keys
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	_, err = ks.storeJWKs(zoneID, result, nil)
+	return err
+}
+
+// now returns the current time of the Clock, or time.Now if no Clock is configured
+func (ks *OIDCTenant) now() time.Time {
+	if ks.Clock == nil {
+		return time.Now()
+	}
+	return ks.Clock()
+}
+
+// updateJWKs fetches the validation keys of zoneID from the server and stores them in memory.
+// Concurrent updates of a zone share one fetch. The lock is not held during the fetch, so that a slow JWKs endpoint does not block the requests
+// which read the cached keys meanwhile. The caller waits for the shared fetch only as long as its own context allows.
+// If the fetch rate limit is exceeded, the cached keys are returned if they are accepted for zoneID, or ErrRateLimited otherwise.
+func (ks *OIDCTenant) updateJWKs(ctx context.Context, zoneID string) (jwk.Set, error) {
+	resultCh := ks.sf.DoChan(zoneID, func() (interface{}, error) {
+		ks.mu.Lock()
+		if !ks.fetchLimit.allow(ks.now(), ks.options.FetchBurst, ks.options.FetchInterval) {
+			defer ks.mu.Unlock()
+			if ks.jwks != nil && ks.acceptedZoneIds[zoneID] {
+				return ks.jwks, nil
+			}
+			return nil, fmt.Errorf("error updating JWKs: %w", ErrRateLimited)
+		}
+		ks.mu.Unlock()
+
+		// the fetch is shared by all callers, so it must not be aborted by the context of the first one
+		fetchCtx, cancel := context.WithTimeout(detachedContext{parent: ctx}, jwksFetchTimeout)
+		defer cancel()
+		result, err := ks.getJWKsFromServer(fetchCtx, zoneID)
+
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		return ks.storeJWKs(zoneID, result, err)
+	})
+	select {
+	case result := <-resultCh:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(jwk.Set), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error updating JWKs: %w", ctx.Err())
+	}
+}
+
+// detachedContext keeps the values of its parent, e.g. the trace span, but is never canceled by it
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// storeJWKs stores the result of getJWKsFromServer for zoneID in memory, or returns its error. The caller must hold the write lock.
+func (ks *OIDCTenant) storeJWKs(zoneID string, result updateKeysResult, err error) (jwk.Set, error) {
+	if result.zoneRejected {
+		ks.acceptedZoneIds[zoneID] = false
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error updating JWKs: %w", err)
+	}
+	ks.acceptedZoneIds[zoneID] = true
+	ks.jwksExpiry = result.expiry
+	ks.jwksFetchedAt = ks.now()
+	ks.jwksZoneID = zoneID
+	ks.jwks = result.keys
 	return ks.jwks, nil
 }
 
-func (ks *OIDCTenant) getJWKsFromServer(zoneID string) (r interface{}, err error) {
+// getJWKsFromServer fetches the keys of zoneID. It does not access the cached state, so the caller needs not hold the lock.
+func (ks *OIDCTenant) getJWKsFromServer(ctx context.Context, zoneID string) (updateKeysResult, error) {
 	result := updateKeysResult{}
-	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, ks.ProviderJSON.JWKsURL, http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.ProviderJSON.JWKsURL, http.NoBody)
 	if err != nil {
 		return result, fmt.Errorf("can't create request to fetch jwk: %v", err)
 	}
 	req.Header.Add(zoneIDHeader, zoneID)
 
-	resp, err := ks.httpClient.Do(req)
+	resp, err := ks.doWithRetry(req)
 	if err != nil {
-		return result, fmt.Errorf("failed to fetch jwks from remote: %v", err)
+		return result, fmt.Errorf("failed to fetch jwks from remote: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		ks.acceptedZoneIds[zoneID] = false
+		result.zoneRejected = isZoneRejection(resp.StatusCode)
 		return result, fmt.Errorf("failed to fetch jwks from remote for x-zone_uuid %s: %v (%s)", zoneID, err, resp.Body)
 	}
-	ks.acceptedZoneIds[zoneID] = true
-	jwks, err := jwk.ParseReader(resp.Body)
+	body, err := readBody(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse JWK set: %w", err)
+		return result, fmt.Errorf("failed to read jwks response: %w", err)
+	}
+	jwks, err := jwk.Parse(body)
+	if err != nil {
+		return result, fmt.Errorf("failed to parse JWK set: %w", err)
 	}
 	result.keys = jwks
-	// If the server doesn't provide cache control headers, assume the keys expire in 15min.
-	result.expiry = time.Now().Add(defaultJwkExpiration)
+	result.expiry = ks.now().Add(ks.jwksTTL(resp.Header))
+	return result, nil
+}
 
-	_, e, err := cachecontrol.CachableResponse(req, resp, cachecontrol.Options{})
-	if err == nil && e.After(result.expiry) {
-		result.expiry = e
+// isZoneRejection reports whether the status code of a failed JWKs response rejects the zone, e.g. 400 for an unknown zone.
+// Responses of an overloaded or unavailable server, i.e. 408, 429 and 5xx, are no rejection, the zone may be accepted once the server recovers.
+func isZoneRejection(statusCode int) bool {
+	switch {
+	case statusCode == http.StatusRequestTimeout, statusCode == http.StatusTooManyRequests:
+		return false
+	default:
+		return statusCode >= 400 && statusCode < 500
 	}
-	return result, nil
 }
 
-func (ks *OIDCTenant) performDiscovery(baseURL string) error {
-	wellKnown := fmt.Sprintf("https://%s/.well-known/openid-configuration", strings.TrimSuffix(baseURL, "/"))
-	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, wellKnown, http.NoBody)
+// jwksTTL returns how long the keys of a JWKs response are cached according to its Cache-Control 'max-age', reduced by its 'Age'.
+// It is bounded by Options.MinJWKsTTL and Options.MaxJWKsTTL, responses with 'no-cache' or 'no-store' are cached for the minimum.
+// If the server doesn't provide a 'max-age', assume the keys expire in 15min.
+func (ks *OIDCTenant) jwksTTL(header http.Header) time.Duration {
+	minTTL, maxTTL := ks.options.MinJWKsTTL, ks.options.MaxJWKsTTL
+	if minTTL <= 0 {
+		minTTL = defaultMinJWKsTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultMaxJWKsTTL
+	}
+
+	ttl := defaultJwkExpiration
+	directives, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	switch {
+	case err != nil:
+		// malformed headers are ignored, the default applies
+	case directives.NoStore || directives.NoCachePresent:
+		ttl = 0
+	case directives.MaxAge >= 0:
+		ttl = time.Duration(directives.MaxAge) * time.Second
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+			ttl -= time.Duration(age) * time.Second
+		}
+	}
+
+	if ttl < minTTL {
+		return minTTL
+	}
+	if ttl > maxTTL {
+		return maxTTL
+	}
+	return ttl
+}
+
+func (ks *OIDCTenant) performDiscovery(ctx context.Context, baseURL string) error {
+	discoveryPath := ks.options.DiscoveryPath
+	if discoveryPath == "" {
+		discoveryPath = defaultDiscoveryPath
+	}
+	wellKnown := fmt.Sprintf("https://%s%s", strings.TrimSuffix(baseURL, "/"), discoveryPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, http.NoBody)
 	if err != nil {
 		return fmt.Errorf("unable to construct discovery request: %v", err)
 	}
-	resp, err := ks.httpClient.Do(req)
+	resp, err := ks.doWithRetry(req)
 	if err != nil {
-		return fmt.Errorf("unable to perform oidc discovery request: %v", err)
+		return fmt.Errorf("unable to perform oidc discovery request: %w", err)
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(resp.Body)
 	if err != nil {
-		return fmt.Errorf("unable to read response body: %v", err)
+		return fmt.Errorf("unable to read response body: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -155,6 +339,9 @@ func (ks *OIDCTenant) performDiscovery(baseURL string) error {
 	if err != nil {
 		return fmt.Errorf("failed to decode provider discovery object: %v", err)
 	}
+	if ks.options.JWKsURL != "" {
+		p.JWKsURL = ks.options.JWKsURL
+	}
 	err = p.assertMandatoryFieldsPresent()
 	if err != nil {
 		return fmt.Errorf("oidc discovery for %v failed: %v", wellKnown, err)
@@ -164,13 +351,36 @@ func (ks *OIDCTenant) performDiscovery(baseURL string) error {
 	return nil
 }
 
-// ProviderJSON represents data which is returned by the tenants /.well-known/openid-configuration endpoint
+// readBody reads the response body up to maxResponseBytes, it returns ErrResponseTooLarge instead of reading larger bodies to the end
+func readBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxResponseBytes {
+		return nil, fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, maxResponseBytes)
+	}
+	return data, nil
+}
+
+// ProviderJSON represents data which is returned by the tenants /.well-known/openid-configuration endpoint.
+// Only Issuer and JWKsURL are mandatory, further endpoints are empty if the tenant does not publish them.
 type ProviderJSON struct {
-	Issuer      string `json:"issuer"`
-	AuthURL     string `json:"authorization_endpoint"`
-	TokenURL    string `json:"token_endpoint"`
-	JWKsURL     string `json:"jwks_uri"`
-	UserInfoURL string `json:"userinfo_endpoint"`
+	Issuer                            string   `json:"issuer"`
+	AuthURL                           string   `json:"authorization_endpoint"`
+	TokenURL                          string   `json:"token_endpoint"`
+	JWKsURL                           string   `json:"jwks_uri"`
+	UserInfoURL                       string   `json:"userinfo_endpoint"`
+	EndSessionURL                     string   `json:"end_session_endpoint,omitempty"`
+	IntrospectionURL                  string   `json:"introspection_endpoint,omitempty"`
+	RevocationURL                     string   `json:"revocation_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported,omitempty"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported             []string `json:"subject_types_supported,omitempty"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
 }
 
 func (p ProviderJSON) assertMandatoryFieldsPresent() error {
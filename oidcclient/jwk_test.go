@@ -5,20 +5,30 @@
 package oidcclient
 
 import (
+	"context"
+	"crypto/ed25519"
+	_ "embed"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwk"
 )
 
 const jwksJSONString = "{\"keys\":[{\"kty\":\"RSA\",\"kid\":\"default-kid-ias\",\"e\":\"AQAB\",\"use\":\"sig\",\"n\":\"AJtUGmczI7RHx3Ypqxz9_9mK_tc-vOXojlJcMm0VRvYvMLIDlIfj1BrkC_IYLpS2Vl1OTG8AS0xAgBDEG3EUzVU6JZKuIuuxD-iXrBySBQA2ytTYtCrjHD7osji7wyogxDJ2BtVz9191gjX7AlU_WKFPpViK2a_2bCL0K4vI3M6-EZMp20wbD2gDsoD1JYqag66WnTDtZqJjQm3mv6Ohj59_C8RMOtPSLX4AxoS-n_8lYneaRc2UFm_vZepgricMNIZ4TuoLekb_fDlg7cvRtH61gD8hH7iFvQfpkf9rxoclPSG21qbxV4svUVW27DOd_Ewo3eSRdnSb8ctuGnXQuKE=\"}]}"
 
+// okpJWKsJSONString is the Ed25519 key of RFC 8037, Appendix A.2
+const okpJWKsJSONString = `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"ed25519-kid","use":"sig","alg":"EdDSA","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`
+
 func TestProviderJSON_assertMandatoryFieldsPresent(t *testing.T) {
 	type fields struct {
 		Issuer  string
@@ -159,7 +169,7 @@ func TestOIDCTenant_ReadJWKs(t *testing.T) {
 				jwks:            jwksJSON,
 				ProviderJSON:    providerJSON,
 			}
-			jwks, err := tenant.GetJWKs(tt.fields.ZoneID)
+			jwks, err := tenant.GetJWKs(context.TODO(), tt.fields.ZoneID)
 			if tt.wantErr {
 				if err == nil {
 					t.Errorf("GetJWKs() does not provide error = %v, zoneID %v", err, tt.fields.ZoneID)
@@ -174,6 +184,685 @@ func TestOIDCTenant_ReadJWKs(t *testing.T) {
 	}
 }
 
+func TestOIDCTenant_RefreshJWKs(t *testing.T) {
+	jwksHitCounter := 0
+	router := mux.NewRouter()
+	router.HandleFunc("/oauth2/certs", func(writer http.ResponseWriter, request *http.Request) {
+		jwksHitCounter++
+		ReturnJWKS(writer, request)
+	}).Methods(http.MethodGet)
+	localServer := httptest.NewServer(router)
+	defer localServer.Close()
+
+	staleJWKs, _ := jwk.ParseString(strings.ReplaceAll(jwksJSONString, "default-kid-ias", "stale-kid"))
+	tenant := OIDCTenant{
+		jwksExpiry:      time.Now().Add(defaultJwkExpiration),
+		acceptedZoneIds: map[string]bool{"zone-id": true},
+		httpClient:      http.DefaultClient,
+		jwks:            staleJWKs,
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL + "/oauth2/certs"},
+	}
+
+	jwks, err := tenant.GetJWKs(context.TODO(), "zone-id")
+	if err != nil {
+		t.Fatalf("GetJWKs() unexpected error = %v", err)
+	}
+	if _, found := jwks.LookupKeyID("default-kid-ias"); found {
+		t.Fatalf("GetJWKs() expected to return stale keys from cache")
+	}
+
+	jwks, err = tenant.RefreshJWKs(context.TODO(), "zone-id")
+	if err != nil {
+		t.Fatalf("RefreshJWKs() unexpected error = %v", err)
+	}
+	if _, found := jwks.LookupKeyID("default-kid-ias"); !found {
+		t.Errorf("RefreshJWKs() expected to return rotated keys")
+	}
+
+	_, err = tenant.RefreshJWKs(context.TODO(), "zone-id")
+	if err != nil {
+		t.Fatalf("RefreshJWKs() unexpected error = %v", err)
+	}
+	if jwksHitCounter != 1 {
+		t.Errorf("RefreshJWKs() jwks endpoint called too often; got = %d, want: 1", jwksHitCounter)
+	}
+}
+
+func TestOIDCTenant_RefreshJWKs_concurrent(t *testing.T) {
+	var jwksHitCounter int32
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&jwksHitCounter, 1)
+		requested <- struct{}{}
+		<-release
+		ReturnJWKS(writer, request)
+	}))
+	defer localServer.Close()
+
+	staleJWKs, _ := jwk.ParseString(strings.ReplaceAll(jwksJSONString, "default-kid-ias", "stale-kid"))
+	tenant := OIDCTenant{
+		jwksExpiry:      time.Now().Add(defaultJwkExpiration),
+		acceptedZoneIds: map[string]bool{"zone-id": true},
+		httpClient:      http.DefaultClient,
+		jwks:            staleJWKs,
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL + "/oauth2/certs"},
+	}
+
+	const callers = 5
+	refreshed := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := tenant.RefreshJWKs(context.TODO(), "zone-id")
+			refreshed <- err
+		}()
+	}
+	<-requested
+
+	// the pending fetch of the slow server must not block reading the cached keys
+	read := make(chan error, 1)
+	go func() {
+		_, err := tenant.GetJWKs(context.TODO(), "zone-id")
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("GetJWKs() unexpected error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("GetJWKs() is blocked by the pending refresh")
+	}
+
+	// a caller whose context is done stops waiting, the shared fetch continues for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := tenant.RefreshJWKs(ctx, "zone-id")
+		canceled <- err
+	}()
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("RefreshJWKs() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RefreshJWKs() waits for the pending refresh despite its canceled context")
+	}
+
+	close(release)
+	for i := 0; i < callers; i++ {
+		if err := <-refreshed; err != nil {
+			t.Errorf("RefreshJWKs() unexpected error = %v", err)
+		}
+	}
+	if hits := atomic.LoadInt32(&jwksHitCounter); hits != 1 {
+		t.Errorf("RefreshJWKs() expected concurrent refreshes to share one fetch; got = %d, want: 1", hits)
+	}
+	jwks, err := tenant.GetJWKs(context.TODO(), "zone-id")
+	if err != nil {
+		t.Fatalf("GetJWKs() unexpected error = %v", err)
+	}
+	if _, found := jwks.LookupKeyID("default-kid-ias"); !found {
+		t.Errorf("RefreshJWKs() expected to store the refreshed keys")
+	}
+}
+
+func TestOIDCTenant_RefreshExpiringJWKs(t *testing.T) {
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(requested)
+		<-release
+		ReturnJWKS(writer, request)
+	}))
+	defer localServer.Close()
+
+	staleJWKs, _ := jwk.ParseString(strings.ReplaceAll(jwksJSONString, "default-kid-ias", "stale-kid"))
+	tenant := OIDCTenant{
+		jwksExpiry:      time.Now().Add(30 * time.Second),
+		jwksZoneID:      "zone-id",
+		acceptedZoneIds: map[string]bool{"zone-id": true},
+		httpClient:      http.DefaultClient,
+		jwks:            staleJWKs,
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL + "/oauth2/certs"},
+	}
+
+	refreshed := make(chan error, 1)
+	go func() {
+		refreshed <- tenant.RefreshExpiringJWKs(context.TODO(), time.Minute)
+	}()
+	<-requested
+
+	// the pending fetch of the slow server must not block reading the cached keys
+	read := make(chan error, 1)
+	go func() {
+		_, err := tenant.GetJWKs(context.TODO(), "zone-id")
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("GetJWKs() unexpected error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("GetJWKs() is blocked by the background refresh")
+	}
+
+	close(release)
+	if err := <-refreshed; err != nil {
+		t.Fatalf("RefreshExpiringJWKs() unexpected error = %v", err)
+	}
+	jwks, err := tenant.GetJWKs(context.TODO(), "zone-id")
+	if err != nil {
+		t.Fatalf("GetJWKs() unexpected error = %v", err)
+	}
+	if _, found := jwks.LookupKeyID("default-kid-ias"); !found {
+		t.Errorf("RefreshExpiringJWKs() expected to store the refreshed keys")
+	}
+}
+
+func TestOIDCTenant_RefreshExpiringJWKs_serverError(t *testing.T) {
+	for _, statusCode := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest} {
+		statusCode := statusCode
+		t.Run(http.StatusText(statusCode), func(t *testing.T) {
+			localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(statusCode)
+			}))
+			defer localServer.Close()
+
+			cachedJWKs, _ := jwk.ParseString(jwksJSONString)
+			tenant := OIDCTenant{
+				jwksExpiry:      time.Now().Add(30 * time.Second),
+				jwksZoneID:      "zone-id",
+				acceptedZoneIds: map[string]bool{"zone-id": true},
+				httpClient:      http.DefaultClient,
+				jwks:            cachedJWKs,
+				ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL + "/oauth2/certs"},
+			}
+
+			if err := tenant.RefreshExpiringJWKs(context.TODO(), time.Minute); err == nil {
+				t.Fatalf("RefreshExpiringJWKs() expected error for status code %d", statusCode)
+			}
+			jwks, err := tenant.GetJWKs(context.TODO(), "zone-id")
+			if err != nil {
+				t.Fatalf("GetJWKs() expected to serve the cached keys after a failed refresh, got error = %v", err)
+			}
+			if jwks != cachedJWKs {
+				t.Errorf("GetJWKs() expected to return the cached keys")
+			}
+		})
+	}
+}
+
+func TestOIDCTenant_GetJWKs_serverError(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCode   int
+		wantRejected bool
+	}{
+		{name: "unknown zone", statusCode: http.StatusBadRequest, wantRejected: true},
+		{name: "not found", statusCode: http.StatusNotFound, wantRejected: true},
+		{name: "too many requests", statusCode: http.StatusTooManyRequests},
+		{name: "service unavailable", statusCode: http.StatusServiceUnavailable},
+		{name: "bad gateway", statusCode: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(tt.statusCode)
+			}))
+			defer localServer.Close()
+
+			cachedJWKs, _ := jwk.ParseString(jwksJSONString)
+			tenant := OIDCTenant{
+				jwksExpiry:      time.Now().Add(defaultJwkExpiration),
+				acceptedZoneIds: map[string]bool{"zone-id": true},
+				httpClient:      http.DefaultClient,
+				jwks:            cachedJWKs,
+				ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL + "/oauth2/certs"},
+			}
+
+			if _, err := tenant.GetJWKs(context.TODO(), "other-zone-id"); err == nil {
+				t.Fatalf("GetJWKs() expected error for status code %d", tt.statusCode)
+			}
+			accepted, known := tenant.acceptedZoneIds["other-zone-id"]
+			if known != tt.wantRejected || accepted {
+				t.Errorf("GetJWKs() zone rejected = %v, want %v", known && !accepted, tt.wantRejected)
+			}
+			if _, err := tenant.GetJWKs(context.TODO(), "zone-id"); err != nil {
+				t.Errorf("GetJWKs() expected to serve the cached keys of the accepted zone, got error = %v", err)
+			}
+		})
+	}
+}
+
+func TestOIDCTenant_Clock(t *testing.T) {
+	jwksHitCounter := 0
+	router := mux.NewRouter()
+	router.HandleFunc("/oauth2/certs", func(writer http.ResponseWriter, request *http.Request) {
+		jwksHitCounter++
+		ReturnJWKS(writer, request)
+	}).Methods(http.MethodGet)
+	localServer := httptest.NewServer(router)
+	defer localServer.Close()
+
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tenant := OIDCTenant{
+		Clock:           func() time.Time { return now },
+		acceptedZoneIds: map[string]bool{},
+		httpClient:      http.DefaultClient,
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL + "/oauth2/certs"},
+	}
+
+	for _, elapsed := range []time.Duration{0, defaultJwkExpiration - time.Second, defaultJwkExpiration + time.Second} {
+		now = now.Add(elapsed)
+		if _, err := tenant.GetJWKs(context.TODO(), "zone-id"); err != nil {
+			t.Fatalf("GetJWKs() unexpected error = %v", err)
+		}
+	}
+	if jwksHitCounter != 2 {
+		t.Errorf("GetJWKs() expected to fetch the keys once more after expiry; got = %d, want: 2", jwksHitCounter)
+	}
+}
+
+func TestOIDCTenant_GetJWKs_cacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		age          string
+		options      Options
+		wantTTL      time.Duration
+	}{
+		{name: "no header", wantTTL: defaultJwkExpiration},
+		{name: "max-age", cacheControl: "public, max-age=3600", wantTTL: time.Hour},
+		{name: "max-age reduced by age", cacheControl: "max-age=3600", age: "600", wantTTL: 50 * time.Minute},
+		{name: "max-age below minimum", cacheControl: "max-age=10", wantTTL: defaultMinJWKsTTL},
+		{name: "max-age above maximum", cacheControl: "max-age=172800", wantTTL: defaultMaxJWKsTTL},
+		{name: "no-cache", cacheControl: "no-cache", wantTTL: defaultMinJWKsTTL},
+		{name: "malformed max-age", cacheControl: "max-age=soon", wantTTL: defaultJwkExpiration},
+		{name: "configured minimum", cacheControl: "max-age=60", options: Options{MinJWKsTTL: 5 * time.Minute}, wantTTL: 5 * time.Minute},
+		{name: "configured maximum", cacheControl: "max-age=3600", options: Options{MaxJWKsTTL: 30 * time.Minute}, wantTTL: 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				if tt.cacheControl != "" {
+					writer.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				if tt.age != "" {
+					writer.Header().Set("Age", tt.age)
+				}
+				ReturnJWKS(writer, request)
+			}))
+			defer localServer.Close()
+
+			now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+			tenant := OIDCTenant{
+				Clock:           func() time.Time { return now },
+				acceptedZoneIds: map[string]bool{},
+				httpClient:      http.DefaultClient,
+				options:         tt.options,
+				ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL},
+			}
+			if _, err := tenant.GetJWKs(context.TODO(), "zone-id"); err != nil {
+				t.Fatalf("GetJWKs() unexpected error = %v", err)
+			}
+			if ttl := tenant.jwksExpiry.Sub(now); ttl != tt.wantTTL {
+				t.Errorf("GetJWKs() cached the keys for %v, want: %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestOIDCTenant_GetJWKs_responseTooLarge(t *testing.T) {
+	localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// valid json of 2 MiB, so that only the size limit rejects it
+		_, _ = writer.Write([]byte(`{"keys":[]` + strings.Repeat(" ", 2*maxResponseBytes) + `}`))
+	}))
+	defer localServer.Close()
+	tenant := OIDCTenant{
+		acceptedZoneIds: map[string]bool{},
+		httpClient:      http.DefaultClient,
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL},
+	}
+
+	_, err := tenant.GetJWKs(context.TODO(), "zone-id")
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("GetJWKs() error = %v, want %v", err, ErrResponseTooLarge)
+	}
+}
+
+func TestNewOIDCTenantWithOptions_responseTooLarge(t *testing.T) {
+	var localServer *httptest.Server
+	localServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(`{"issuer":"` + localServer.URL + `","jwks_uri":"` + localServer.URL + `/oauth2/certs","padding":"` + strings.Repeat("x", 2*maxResponseBytes) + `"}`))
+	}))
+	defer localServer.Close()
+	issuer, _ := url.Parse(localServer.URL)
+
+	_, err := NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{})
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("NewOIDCTenantWithOptions() error = %v, want %v", err, ErrResponseTooLarge)
+	}
+}
+
+func TestOIDCTenant_GetJWKs_okp(t *testing.T) {
+	localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(okpJWKsJSONString))
+	}))
+	defer localServer.Close()
+	tenant := OIDCTenant{
+		acceptedZoneIds: map[string]bool{},
+		httpClient:      http.DefaultClient,
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL},
+	}
+
+	jwks, err := tenant.GetJWKs(context.TODO(), "zone-id")
+	if err != nil {
+		t.Fatalf("GetJWKs() unexpected error = %v", err)
+	}
+	key, found := jwks.LookupKeyID("ed25519-kid")
+	if !found {
+		t.Fatalf("GetJWKs() expected to return the Ed25519 key")
+	}
+	if key.KeyType() != jwa.OKP {
+		t.Errorf("GetJWKs() key type got = %s, want %s", key.KeyType(), jwa.OKP)
+	}
+	var publicKey ed25519.PublicKey
+	if err := key.Raw(&publicKey); err != nil || len(publicKey) != ed25519.PublicKeySize {
+		t.Errorf("GetJWKs() expected raw Ed25519 public key, got error = %v", err)
+	}
+}
+
+func TestOIDCTenant_GetJWKs_rateLimit(t *testing.T) {
+	jwksHitCounter := 0
+	localServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		jwksHitCounter++
+		ReturnJWKS(writer, request)
+	}))
+	defer localServer.Close()
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tenant := OIDCTenant{
+		Clock:           func() time.Time { return now },
+		acceptedZoneIds: map[string]bool{},
+		httpClient:      http.DefaultClient,
+		options:         Options{FetchBurst: 2, FetchInterval: 10 * time.Minute},
+		ProviderJSON:    ProviderJSON{JWKsURL: localServer.URL},
+	}
+
+	rateLimited := 0
+	for i := 0; i < 10; i++ {
+		_, err := tenant.GetJWKs(context.TODO(), fmt.Sprintf("zone-id-%d", i))
+		if errors.Is(err, ErrRateLimited) {
+			rateLimited++
+		} else if err != nil {
+			t.Fatalf("GetJWKs() unexpected error = %v", err)
+		}
+	}
+	if jwksHitCounter != 2 || rateLimited != 8 {
+		t.Errorf("GetJWKs() expected burst of 2 fetches; got = %d fetches and %d rate limited", jwksHitCounter, rateLimited)
+	}
+	now = now.Add(2 * minJwkRefetchInterval)
+	if _, err := tenant.RefreshJWKs(context.TODO(), "zone-id-1"); err != nil || jwksHitCounter != 2 {
+		t.Errorf("RefreshJWKs() expected cached keys of accepted zone if rate limited, got error = %v", err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if _, err := tenant.GetJWKs(context.TODO(), "zone-id-9"); err != nil {
+		t.Fatalf("GetJWKs() unexpected error after refill = %v", err)
+	}
+	if jwksHitCounter != 3 {
+		t.Errorf("GetJWKs() expected one more fetch after interval; got = %d, want: 3", jwksHitCounter)
+	}
+}
+
+func TestNewOIDCTenantWithOptions_retries(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		failureCode int
+		retries     int
+		wantErr     bool
+		wantHits    int
+	}{
+		{
+			name:        "succeeds after transient failures",
+			failures:    2,
+			failureCode: http.StatusServiceUnavailable,
+			retries:     2,
+			wantHits:    3,
+		}, {
+			name:        "fails if retries are exhausted",
+			failures:    3,
+			failureCode: http.StatusBadGateway,
+			retries:     2,
+			wantErr:     true,
+			wantHits:    3,
+		}, {
+			name:        "no retry on 4xx",
+			failures:    1,
+			failureCode: http.StatusNotFound,
+			retries:     2,
+			wantErr:     true,
+			wantHits:    1,
+		}, {
+			name:        "no retry by default",
+			failures:    1,
+			failureCode: http.StatusInternalServerError,
+			wantErr:     true,
+			wantHits:    1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			var localServer *httptest.Server
+			localServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				hits++
+				if hits <= tt.failures {
+					writer.WriteHeader(tt.failureCode)
+					return
+				}
+				_, _ = writer.Write([]byte(`{"issuer":"` + localServer.URL + `","jwks_uri":"` + localServer.URL + `/oauth2/certs"}`))
+			}))
+			defer localServer.Close()
+			issuer, _ := url.Parse(localServer.URL)
+
+			_, err := NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{
+				Retries:        tt.retries,
+				RetryBaseDelay: time.Millisecond,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewOIDCTenantWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if hits != tt.wantHits {
+				t.Errorf("NewOIDCTenantWithOptions() discovery endpoint hits got = %d, want: %d", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestNewOIDCTenantWithOptions_retryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		retryAfter string
+		minElapsed time.Duration
+	}{
+		{name: "delta-seconds capped by max", statusCode: http.StatusTooManyRequests, retryAfter: "120", minElapsed: 50 * time.Millisecond},
+		{name: "http-date capped by max", statusCode: http.StatusServiceUnavailable, retryAfter: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), minElapsed: 50 * time.Millisecond},
+		{name: "missing header uses backoff", statusCode: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			var localServer *httptest.Server
+			localServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				hits++
+				if hits == 1 {
+					if tt.retryAfter != "" {
+						writer.Header().Set("Retry-After", tt.retryAfter)
+					}
+					writer.WriteHeader(tt.statusCode)
+					return
+				}
+				_, _ = writer.Write([]byte(`{"issuer":"` + localServer.URL + `","jwks_uri":"` + localServer.URL + `/oauth2/certs"}`))
+			}))
+			defer localServer.Close()
+			issuer, _ := url.Parse(localServer.URL)
+
+			start := time.Now()
+			_, err := NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{
+				Retries:        1,
+				RetryBaseDelay: time.Millisecond,
+				MaxRetryAfter:  50 * time.Millisecond,
+			})
+			elapsed := time.Since(start)
+			if err != nil {
+				t.Fatalf("NewOIDCTenantWithOptions() unexpected error = %v", err)
+			}
+			if hits != 2 {
+				t.Errorf("NewOIDCTenantWithOptions() discovery endpoint hits got = %d, want: 2", hits)
+			}
+			if elapsed < tt.minElapsed || elapsed > 5*time.Second {
+				t.Errorf("NewOIDCTenantWithOptions() retried after %v, want at least %v", elapsed, tt.minElapsed)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		value     string
+		wantDelay time.Duration
+		wantOk    bool
+	}{
+		{name: "delta-seconds", value: "30", wantDelay: 30 * time.Second, wantOk: true},
+		{name: "http-date", value: "Wed, 01 Jan 2020 12:02:00 GMT", wantDelay: 2 * time.Minute, wantOk: true},
+		{name: "http-date in the past", value: "Wed, 01 Jan 2020 11:00:00 GMT", wantDelay: 0, wantOk: true},
+		{name: "missing", value: ""},
+		{name: "negative", value: "-1"},
+		{name: "malformed", value: "soon"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := parseRetryAfter(tt.value, now)
+			if delay != tt.wantDelay || ok != tt.wantOk {
+				t.Errorf("parseRetryAfter() got = %v, %v, want: %v, %v", delay, ok, tt.wantDelay, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestNewOIDCTenantWithOptions_discoveryPath(t *testing.T) {
+	var requestedPaths []string
+	var localServer *httptest.Server
+	localServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestedPaths = append(requestedPaths, request.URL.Path)
+		if request.URL.Path != "/oidc/discovery" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = writer.Write([]byte(`{"issuer":"` + localServer.URL + `","jwks_uri":"` + localServer.URL + `/oauth2/certs"}`))
+	}))
+	defer localServer.Close()
+	issuer, _ := url.Parse(localServer.URL)
+
+	tenant, err := NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{DiscoveryPath: "/oidc/discovery"})
+	if err != nil {
+		t.Fatalf("NewOIDCTenantWithOptions() unexpected error = %v", err)
+	}
+	if tenant.ProviderJSON.Issuer != localServer.URL {
+		t.Errorf("NewOIDCTenantWithOptions() issuer got = %s, want %s", tenant.ProviderJSON.Issuer, localServer.URL)
+	}
+	if !reflect.DeepEqual(requestedPaths, []string{"/oidc/discovery"}) {
+		t.Errorf("NewOIDCTenantWithOptions() requested paths got = %v, want only the custom discovery path", requestedPaths)
+	}
+
+	if _, err = NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{}); err == nil {
+		t.Errorf("NewOIDCTenantWithOptions() expected the standard path to be requested by default")
+	}
+	if last := requestedPaths[len(requestedPaths)-1]; last != defaultDiscoveryPath {
+		t.Errorf("NewOIDCTenantWithOptions() default path got = %s, want %s", last, defaultDiscoveryPath)
+	}
+}
+
+func TestNewOIDCTenantWithOptions_jwksURL(t *testing.T) {
+	var localServer *httptest.Server
+	localServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(`{"issuer":"` + localServer.URL + `"}`))
+	}))
+	defer localServer.Close()
+	issuer, _ := url.Parse(localServer.URL)
+
+	tenant, err := NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{JWKsURL: "https://mirror.example.com/certs"})
+	if err != nil {
+		t.Fatalf("NewOIDCTenantWithOptions() unexpected error = %v", err)
+	}
+	if tenant.ProviderJSON.JWKsURL != "https://mirror.example.com/certs" {
+		t.Errorf("NewOIDCTenantWithOptions() jwks_uri got = %s, want the override", tenant.ProviderJSON.JWKsURL)
+	}
+	if tenant.ProviderJSON.Issuer != localServer.URL {
+		t.Errorf("NewOIDCTenantWithOptions() issuer got = %s, want %s", tenant.ProviderJSON.Issuer, localServer.URL)
+	}
+}
+
+//go:embed testdata/openid-configuration.json
+var discoveryDocument string
+
+func TestNewOIDCTenantWithOptions_discoveryDocument(t *testing.T) {
+	var localServer *httptest.Server
+	localServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(strings.ReplaceAll(discoveryDocument, "{{issuer}}", localServer.URL)))
+	}))
+	defer localServer.Close()
+	issuer, _ := url.Parse(localServer.URL)
+
+	tenant, err := NewOIDCTenantWithOptions(context.TODO(), localServer.Client(), issuer, Options{})
+	if err != nil {
+		t.Fatalf("NewOIDCTenantWithOptions() unexpected error = %v", err)
+	}
+	want := ProviderJSON{
+		Issuer:                            localServer.URL,
+		AuthURL:                           localServer.URL + "/oauth2/authorize",
+		TokenURL:                          localServer.URL + "/oauth2/token",
+		JWKsURL:                           localServer.URL + "/oauth2/certs",
+		UserInfoURL:                       localServer.URL + "/oauth2/userinfo",
+		EndSessionURL:                     localServer.URL + "/oauth2/logout",
+		IntrospectionURL:                  localServer.URL + "/oauth2/introspect",
+		RevocationURL:                     localServer.URL + "/oauth2/revoke",
+		ScopesSupported:                   []string{"openid", "email", "profile", "groups"},
+		ResponseTypesSupported:            []string{"code", "id_token", "token"},
+		GrantTypesSupported:               []string{"authorization_code", "client_credentials", "password", "refresh_token", "urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "tls_client_auth"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "email", "given_name", "family_name", "app_tid"},
+	}
+	if !reflect.DeepEqual(tenant.ProviderJSON, want) {
+		t.Errorf("NewOIDCTenantWithOptions() ProviderJSON got = %+v, want %+v", tenant.ProviderJSON, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 4; attempt++ {
+		want := 100 * time.Millisecond << uint(attempt)
+		got := backoff(100*time.Millisecond, attempt)
+		if got < want/2 || got > want {
+			t.Errorf("backoff() for attempt %d got = %v, want between %v and %v", attempt, got, want/2, want)
+		}
+	}
+}
+
 func NewRouter() (r *mux.Router) {
 	r = mux.NewRouter()
 	r.HandleFunc("/oauth2/certs", ReturnJWKS).Methods(http.MethodGet).Headers("x-zone_uuid", "zone-id")
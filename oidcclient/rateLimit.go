@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package oidcclient
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRateLimited is returned if the JWKs need to be fetched, but the fetches of the OIDCTenant exceeded Options.FetchBurst and no cached keys are available
+var ErrRateLimited = errors.New("jwks fetch rate limit exceeded")
+
+// tokenBucket limits the frequency of events: it holds up to burst tokens, each event takes one and a token is refilled every interval.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token at now and reports whether one was available. A burst or interval of 0 disables the limit.
+func (b *tokenBucket) allow(now time.Time, burst int, interval time.Duration) bool {
+	if burst <= 0 || interval <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(interval)
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2023 SAP SE or an SAP affiliate company and Cloud Security Client Go contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package oidcclient
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultMaxRetryAfter = 10 * time.Second
+
+// doWithRetry performs the idempotent request and retries it on connection errors, 429 and 5xx responses with exponential backoff and jitter.
+// If a 429 or 503 response carries a Retry-After header, the retry waits as long as requested instead, at most Options.MaxRetryAfter. Other 4xx responses are returned without retry. The backoff ends early if the context of the request is done.
+func (ks *OIDCTenant) doWithRetry(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := ks.httpClient.Do(req)
+		if attempt >= ks.options.Retries || !isRetryable(req.Context(), resp, err) {
+			return resp, err
+		}
+		delay := ks.retryDelay(resp, attempt)
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryable returns true for transient failures, i.e. connection errors which are not caused by the context, 429 and 5xx responses
+func isRetryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryDelay returns the Retry-After of 429 and 503 responses capped by Options.MaxRetryAfter, or the backoff of the attempt otherwise
+func (ks *OIDCTenant) retryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), ks.now()); ok {
+			maxDelay := ks.options.MaxRetryAfter
+			if maxDelay <= 0 {
+				maxDelay = defaultMaxRetryAfter
+			}
+			if delay > maxDelay {
+				return maxDelay
+			}
+			return delay
+		}
+	}
+	return backoff(ks.options.RetryBaseDelay, attempt)
+}
+
+// parseRetryAfter parses the Retry-After header in its delta-seconds or HTTP-date form, a date in the past results in no delay.
+// It returns false if the header is missing or malformed.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// backoff returns the delay before the next retry: baseDelay doubled per attempt, randomized between half and the full value
+func backoff(baseDelay time.Duration, attempt int) time.Duration {
+	delay := baseDelay << uint(attempt)
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2 //nolint:gomnd // jitter within the upper half of the delay
+
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1)) //nolint:gosec // the jitter needs no cryptographic randomness
+}
@@ -44,6 +44,10 @@ func main() {
 }
 
 func helloWorld(w http.ResponseWriter, r *http.Request) {
-	user := auth.TokenFromCtx(r)
+	user, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no claims found in request context", http.StatusInternalServerError)
+		return
+	}
 	_, _ = fmt.Fprintf(w, "Hello world!\nYou're logged in as %s", user.Email())
 }